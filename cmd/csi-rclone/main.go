@@ -28,20 +28,57 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/xhebox/csi-driver-rclone/pkg/driver"
 )
 
+// set by the Makefile through -ldflags
+var (
+	Version = "v0.1"
+	Commit  = "unknown"
+)
+
 func main() {
 	cfg := driver.Config{
-		PluginVersion: "v0.1",
+		PluginVersion: Version,
+		Commit:        Commit,
 	}
 
+	flag.StringVar((*string)(&cfg.Mode), "mode", string(driver.ModeAll), "services to serve: controller, node or all")
+	flag.StringVar(&cfg.Instance, "instance", "", "instance name, to run several drivers on a node")
+	flag.StringVar(&cfg.PluginName, "name", "", "CSI plugin name (default csi-rclone[-<instance>])")
 	flag.StringVar(&cfg.Endpoint, "endpoint", "unix://tmp/csi.sock", "CSI endpoint")
 	flag.StringVar(&cfg.NodeID, "nodeid", "", "node id")
-	flag.StringVar(&cfg.RcloneConfig, "config", "", "rclone config")
+	flag.StringVar(&cfg.RcloneConfig, "config", "", "rclone config (default the one of rclone, or <state-dir>/rclone.conf with -instance)")
+	flag.StringVar(&cfg.StateDir, "state-dir", "", "state directory (default /var/lib/csi-rclone[-<instance>])")
+	flag.StringVar(&cfg.CacheDir, "cache-dir", "", "rclone cache directory (default /var/cache/csi-rclone[-<instance>])")
+	flag.StringVar(&cfg.RcAddr, "rc-addr", "", "rc address of rcd (default unix://<state-dir>/rc.sock)")
+	flag.Func("cache-max-size", "limit of the VFS caches of all volumes, e.g. 100G (default unlimited)", sizeFlag(&cfg.CacheMaxSize))
+	flag.Func("cache-volume-size", "VFS cache size of volumes without cacheMaxSize", sizeFlag(&cfg.CacheVolumeSize))
+	flag.Func("cache-min-free-space", "free space VFS caches leave on the cache disk, unless set by the volume", sizeFlag(&cfg.CacheMinFreeSpace))
+	flag.StringVar(&cfg.MetricsAddr, "metrics-addr", "", "address serving metrics at /debug/vars, e.g. 127.0.0.1:9090 (default disabled)")
+	flag.StringVar(&cfg.AdminAddr, "admin-addr", "", "address of the admin api of the node, e.g. unix:///run/csi-rclone-admin.sock (default disabled)")
+	flag.BoolVar(&cfg.Attach, "attach", false, "record attachments in the controller, and only publish attached volumes on nodes; needs a single controller")
+	flag.StringVar(&cfg.DefaultMounter, "default-mounter", "fuse", "mounter of volumes without one: fuse, nfs, webdav, copy, bisync or bind")
+	flag.DurationVar(&cfg.HealthInterval, "health-interval", 30*time.Second, "period of the health checks of mounts, 0 disables them")
+	flag.DurationVar(&cfg.HealthTimeout, "health-timeout", 10*time.Second, "time mounts have to answer health checks")
+	flag.Func("inline-backends", "comma separated backend types inline volumes may use, empty to refuse them (default storage services, no local or wrapping backends)", func(s string) error {
+		cfg.InlineBackends = []string{}
+		if s != "" {
+			cfg.InlineBackends = strings.Split(s, ",")
+		}
+		return nil
+	})
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn or error")
 	flag.Parse()
 
+	if err := driver.SetupLogging(os.Stderr, *logLevel); err != nil {
+		fmt.Printf("Failed to setup logging: %s", err.Error())
+		os.Exit(1)
+	}
+
 	driver, err := driver.NewDriver(cfg)
 	if err != nil {
 		fmt.Printf("Failed to initialize driver: %s", err.Error())
@@ -54,3 +91,10 @@ func main() {
 
 	}
 }
+
+func sizeFlag(v *int64) func(string) error {
+	return func(s string) (err error) {
+		*v, err = driver.ParseSize(s)
+		return err
+	}
+}
@@ -0,0 +1,39 @@
+job "csi-rclone-controller" {
+  type = "service"
+  group "controller" {
+    # attachments are recorded by a single controller
+    count = 1
+
+    # keeps the attachments across restarts, declare it in the client
+    # config of the nodes on persistent storage
+    volume "state" {
+      type   = "host"
+      source = "csi-rclone-controller"
+    }
+
+    task "plugin" {
+      driver = "podman"
+      config {
+        image = "docker://xhebox/csi-rclone:controller"
+        args = [
+          "-mode=controller",
+          "-endpoint=unix://csi/csi.sock",
+          "-attach",
+        ]
+      }
+      volume_mount {
+        volume      = "state"
+        destination = "/var/lib/csi-rclone"
+      }
+      csi_plugin {
+        id        = "csi-rclone"
+        type      = "controller"
+        mount_dir = "/csi"
+      }
+      resources {
+        cpu    = 100
+        memory = 100
+      }
+    }
+  }
+}
@@ -0,0 +1,27 @@
+job "csi-rclone-node" {
+  type = "system"
+  group "node" {
+    task "plugin" {
+      driver = "podman"
+      config {
+        image      = "docker://xhebox/csi-rclone:latest"
+        privileged = true
+        args = [
+          "-mode=node",
+          "-endpoint=unix://csi/csi.sock",
+          "-nodeid=${node.unique.id}",
+          "-attach",
+        ]
+      }
+      csi_plugin {
+        id        = "csi-rclone"
+        type      = "node"
+        mount_dir = "/csi"
+      }
+      resources {
+        cpu    = 100
+        memory = 200
+      }
+    }
+  }
+}
@@ -0,0 +1,380 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// uploads of paused volumes are postponed by pauseHold, and postponed
+// again every pauseInterval.
+const (
+	pauseHold     = time.Hour
+	pauseInterval = 10 * time.Second
+)
+
+// serveAdmin serves the admin API on addr, either host:port or
+// unix:///path/to/socket, until the listener fails.
+func (d *driver) serveAdmin(addr string) error {
+	var l net.Listener
+	var err error
+	if socket, ok := strings.CutPrefix(addr, "unix://"); ok {
+		if err = os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		l, err = net.Listen("unix", socket)
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	slog.Info("serving admin api", "addr", addr)
+	return http.Serve(l, d.adminHandler())
+}
+
+// adminHandler routes the admin API:
+//
+//	GET  /mounts                      publications of the node
+//	POST /volumes/<id>/refresh        vfs/refresh, ?dir=&recursive=true
+//	POST /volumes/<id>/forget         vfs/forget, ?dir=
+//	POST /volumes/<id>/bwlimit        core/bwlimit, ?rate=
+//	POST /volumes/<id>/pause          postpone uploads
+//	POST /volumes/<id>/resume         resume uploads
+//	POST /volumes/<id>/flush          upload now, ?wait=true
+//	POST /volumes/<id>/resolve        conflict policy of copies, ?conflict=
+//	POST /volumes/<id>/resync         resync bisync volumes
+//
+// Only volumes published by the driver can be acted on.
+func (d *driver) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mounts", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			adminError(w, status.Error(codes.Unimplemented, "method not allowed"))
+			return
+		}
+		adminReply(w, d.publications.list())
+	})
+	mux.HandleFunc("/volumes/", func(w http.ResponseWriter, r *http.Request) {
+		id, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/volumes/"), "/")
+		if !ok || id == "" || r.Method != http.MethodPost {
+			adminError(w, status.Error(codes.Unimplemented, "unknown request"))
+			return
+		}
+		pubs := []*publication{}
+		for _, pub := range d.publications.list() {
+			if pub.VolumeID == id {
+				pubs = append(pubs, pub)
+			}
+		}
+		if len(pubs) == 0 {
+			adminError(w, status.Errorf(codes.NotFound, "volume %s is not published on the node", id))
+			return
+		}
+
+		ctx := withLogger(r.Context(), slog.Default().With("admin", action, "volume_id", id, "request_id", randomID()))
+		q := r.URL.Query()
+		res := map[string]any{}
+		failed := map[string]string{}
+		var firstErr error
+		for _, pub := range pubs {
+			var out any
+			var rc gjson.Result
+			var err error
+			switch action {
+			case "refresh":
+				rc, err = d.rcVFS(ctx, pub, "vfs/refresh", q.Get("dir"), map[string]any{"recursive": strconv.FormatBool(q.Get("recursive") == "true")})
+				out = rc.Value()
+			case "forget":
+				rc, err = d.rcVFS(ctx, pub, "vfs/forget", q.Get("dir"), nil)
+				out = rc.Value()
+			case "bwlimit":
+				out, err = d.adminBwlimit(ctx, pub, q.Get("rate"))
+			case "pause":
+				err = d.pauseUploads(ctx, pub)
+			case "resume":
+				err = d.resumeUploads(ctx, pub)
+			case "flush":
+				err = d.flushUploads(ctx, pub, q.Get("wait") == "true")
+			case "resolve":
+				err = d.resolveConflicts(pub, q.Get("conflict"))
+			case "resync":
+				err = d.resync(ctx, pub)
+			default:
+				err = status.Errorf(codes.Unimplemented, "unknown action %q", action)
+			}
+			if err != nil {
+				// the other publications are still acted on
+				logFrom(ctx).Error("admin request failed", "target_path", pub.TargetPath, "err", err)
+				failed[pub.TargetPath] = secrets.String(status.Convert(err).Message())
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			logFrom(ctx).Info("admin request", "target_path", pub.TargetPath)
+			res[pub.TargetPath] = out
+		}
+		switch {
+		case firstErr == nil:
+			adminReply(w, res)
+		case len(res) == 0 && len(pubs) == 1:
+			adminError(w, firstErr)
+		default:
+			adminPartial(w, firstErr, len(pubs), res, failed)
+		}
+	})
+	return mux
+}
+
+func adminReply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to write admin reply", "err", err)
+	}
+}
+
+func adminError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(adminCode(err))
+	json.NewEncoder(w).Encode(map[string]string{"error": secrets.String(status.Convert(err).Message())})
+}
+
+// adminPartial replies to a request which failed on some of the n
+// publications of a volume, with the results of the ones it was applied to
+// and the errors of the others. The status is the one of err, the first
+// error, if the request failed everywhere, 207 otherwise.
+func adminPartial(w http.ResponseWriter, err error, n int, applied map[string]any, failed map[string]string) {
+	code := adminCode(err)
+	if len(applied) > 0 {
+		code = http.StatusMultiStatus
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":   fmt.Sprintf("failed on %d of %d publications: %s", len(failed), n, secrets.String(status.Convert(err).Message())),
+		"applied": applied,
+		"failed":  failed,
+	})
+}
+
+// adminCode is the http status of err.
+func adminCode(err error) int {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.FailedPrecondition:
+		return http.StatusConflict
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
+
+// rcVFS calls the vfs method of rclone on dir of pub. rclone finds the VFS
+// by the name of its remote, so vfs methods fail on a volume mounted more
+// than once by the same rcd, e.g. published to several targets without
+// limits of its own, or left behind by the remount of a hung mount.
+func (d *driver) rcVFS(ctx context.Context, pub *publication, method, dir string, params map[string]any) (gjson.Result, error) {
+	res, err := d.rcTarget(ctx, pub.TargetPath, method, vfsParams(pub, dir, params))
+	if err != nil && ambiguousVFS(err) {
+		err = status.Errorf(codes.FailedPrecondition, "%s: the volume is mounted more than once by the shared rclone, which can not tell its mounts apart, publish it with %s to give each publication an rclone of its own", method, bwlimitKey)
+	}
+	return res, err
+}
+
+// ambiguousVFS tells if err is rclone failing to pick the VFS of a volume
+// mounted more than once.
+func ambiguousVFS(err error) bool {
+	return strings.Contains(err.Error(), "more than one VFS active")
+}
+
+// vfsParams are the parameters of vfs methods on dir of pub, all of the
+// VFS if dir is empty.
+func vfsParams(pub *publication, dir string, params map[string]any) map[string]any {
+	if params == nil {
+		params = map[string]any{}
+	}
+	params["fs"] = fmt.Sprintf("%s:%s", pub.Remote, pub.RemotePath)
+	if dir != "" {
+		params["dir"] = dir
+	}
+	return params
+}
+
+// adminBwlimit sets the bandwidth limit of pub, if rate is not empty, and
+// returns the current limit. Only volumes with their own rcd have a limit
+// of their own, changing the one of the shared rcd would affect all.
+func (d *driver) adminBwlimit(ctx context.Context, pub *publication, rate string) (any, error) {
+	if len(pub.Limits) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume has no limits of its own, publish it with %s", bwlimitKey)
+	}
+	params := map[string]any{}
+	if rate != "" {
+		params["rate"] = rate
+	}
+	res, err := d.rcTarget(ctx, pub.TargetPath, "core/bwlimit", params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return res.Value(), nil
+}
+
+// uploadQueue returns the ids of queued uploads of pub by their expiry in
+// seconds, leaving out the ones in progress.
+func (d *driver) uploadQueue(ctx context.Context, pub *publication) (map[int64]float64, error) {
+	if !d.feature("upload queue control", "vfs/queue", "vfs/queue-set-expiry") {
+		return nil, status.Errorf(codes.Unimplemented, "rclone %s can not control upload queues", d.rclone.Version)
+	}
+	res, err := d.rcVFS(ctx, pub, "vfs/queue", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	queue := map[int64]float64{}
+	for _, item := range res.Get("queue").Array() {
+		if !item.Get("uploading").Bool() {
+			queue[item.Get("id").Int()] = item.Get("expiry").Float()
+		}
+	}
+	return queue, nil
+}
+
+// setExpiry reschedules the queued uploads of pub matching f in seconds.
+func (d *driver) setExpiry(ctx context.Context, pub *publication, expiry float64, f func(current float64) bool) error {
+	queue, err := d.uploadQueue(ctx, pub)
+	if err != nil {
+		return err
+	}
+	for id, current := range queue {
+		if !f(current) {
+			continue
+		}
+		_, err := d.rcTarget(ctx, pub.TargetPath, "vfs/queue-set-expiry", vfsParams(pub, "", map[string]any{
+			"id":     id,
+			"expiry": expiry,
+		}))
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			return err
+		}
+	}
+	return nil
+}
+
+// pauseUploads postpones the uploads of pub until resumeUploads. Uploads
+// in progress complete, new ones are postponed as they are queued.
+func (d *driver) pauseUploads(ctx context.Context, pub *publication) error {
+	hold := pauseHold.Seconds()
+	if err := d.setExpiry(ctx, pub, hold, func(float64) bool { return true }); err != nil {
+		return err
+	}
+	d.pauses.start(pub.TargetPath, func(ctx context.Context) {
+		l := slog.Default().With("volume_id", pub.VolumeID, "target_path", pub.TargetPath)
+		t := time.NewTicker(pauseInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			err := d.setExpiry(ctx, pub, hold, func(current float64) bool {
+				return current < hold-2*pauseInterval.Seconds()
+			})
+			if err != nil && ctx.Err() == nil {
+				l.Warn("failed to postpone uploads", "err", err)
+			}
+		}
+	})
+	return nil
+}
+
+// resumeUploads undoes pauseUploads, postponed uploads start right away.
+func (d *driver) resumeUploads(ctx context.Context, pub *publication) error {
+	d.pauses.stop(pub.TargetPath)
+	return d.setExpiry(ctx, pub, 0, func(float64) bool { return true })
+}
+
+// flushUploads starts all queued uploads of pub, and waits for them if
+// wait is set.
+func (d *driver) flushUploads(ctx context.Context, pub *publication, wait bool) error {
+	d.pauses.stop(pub.TargetPath)
+	if err := d.setExpiry(ctx, pub, 0, func(float64) bool { return true }); err != nil {
+		return err
+	}
+	if wait {
+		return d.waitUploads(ctx, pub)
+	}
+	return nil
+}
+
+// resolveConflicts changes the conflict policy of the copy of pub, e.g.
+// for unpublishing to succeed after conflicts.
+func (d *driver) resolveConflicts(pub *publication, conflict string) error {
+	if pub.Copy == nil {
+		return status.Errorf(codes.FailedPrecondition, "volume is not mounted with %s=%s or %s", mounterKey, mounterCopy, mounterBisync)
+	}
+	valid := conflict == conflictFail || conflict == conflictLocal || conflict == conflictRemote
+	if pub.Copy.Bisync {
+		valid = validBisyncConflict(conflict)
+	}
+	if !valid {
+		return status.Errorf(codes.InvalidArgument, "invalid %s %q", conflictKey, conflict)
+	}
+	unlock := lockCopy(pub)
+	defer unlock()
+	return d.publications.update(pub.TargetPath, func(pub *publication) {
+		pub.Copy.Conflict = conflict
+	})
+}
+
+// resync runs bisync for pub with resync, after bisync lost track of the
+// changes of both sides.
+func (d *driver) resync(ctx context.Context, pub *publication) error {
+	if pub.Copy == nil || !pub.Copy.Bisync {
+		return status.Errorf(codes.FailedPrecondition, "volume is not mounted with %s=%s", mounterKey, mounterBisync)
+	}
+	if err := d.holdLease(ctx, pub, false); err != nil {
+		return err
+	}
+	unlock := lockCopy(pub)
+	defer unlock()
+	return d.bisync(ctx, pub, true)
+}
@@ -0,0 +1,96 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+func TestAdminAmbiguousVFS(t *testing.T) {
+	d, b, _ := newTestDriver(t)
+	b.errs = map[string]string{"vfs/refresh": `more than one VFS active with name "vol:"`}
+	ctx := context.Background()
+	dir := t.TempDir()
+	// three publications in the shared rcd, the last one gets an rcd of its
+	// own below
+	shared := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	own := filepath.Join(dir, "c")
+	for _, target := range append(shared, own) {
+		_, err := d.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:         "vol",
+			TargetPath:       target,
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := d.adminHandler()
+	refresh := func() (int, map[string]any) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/volumes/vol/refresh", nil))
+		var body map[string]any
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, body
+	}
+
+	code, body := refresh()
+	if code != http.StatusConflict {
+		t.Errorf("got status %d, want %d", code, http.StatusConflict)
+	}
+	failed, _ := body["failed"].(map[string]any)
+	for _, target := range append(shared, own) {
+		msg, _ := failed[target].(string)
+		if !strings.Contains(msg, "mounted more than once") {
+			t.Errorf("got error %q for %s", msg, target)
+		}
+	}
+
+	d.volumeBackends.byTarget[own] = &fakeBackend{}
+	code, body = refresh()
+	if code != http.StatusMultiStatus {
+		t.Errorf("got status %d, want %d", code, http.StatusMultiStatus)
+	}
+	applied, _ := body["applied"].(map[string]any)
+	failed, _ = body["failed"].(map[string]any)
+	if _, ok := applied[own]; !ok || len(applied) != 1 {
+		t.Errorf("applied to %v, want %s", applied, own)
+	}
+	for _, target := range shared {
+		if _, ok := failed[target]; !ok {
+			t.Errorf("%s is not reported as failed", target)
+		}
+	}
+}
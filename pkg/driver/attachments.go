@@ -0,0 +1,204 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Publish context keys, passed by the controller to the node it attached a
+// volume to.
+const (
+	publishNodeKey       = "csi-rclone/node-id"
+	publishReadonlyKey   = "csi-rclone/readonly"
+	publishAttachmentKey = "csi-rclone/attachment-id"
+)
+
+// attachmentsFile mirrors the attachments of a volume at the root of its
+// remote path, for nodes to check that a publish context is current.
+const attachmentsFile = ".csi-rclone.attachments"
+
+// attachment is a volume attached by the controller to a node.
+type attachment struct {
+	ID         string                               `json:"id"`
+	VolumeID   string                               `json:"volumeId"`
+	NodeID     string                               `json:"nodeId"`
+	Readonly   bool                                 `json:"readonly"`
+	AccessMode csi.VolumeCapability_AccessMode_Mode `json:"accessMode"`
+	// Path is the remote path of the volume, where attachmentsFile is
+	Path string `json:"path,omitempty"`
+}
+
+func (a *attachment) publishContext() map[string]string {
+	return map[string]string{
+		publishNodeKey:       a.NodeID,
+		publishReadonlyKey:   strconv.FormatBool(a.Readonly),
+		publishAttachmentKey: a.ID,
+	}
+}
+
+// attachments tracks the attachments of the controller, persisted in the
+// state directory.
+type attachments struct {
+	path string
+
+	mu       sync.Mutex
+	byVolume map[string][]*attachment
+}
+
+func loadAttachments(path string) (*attachments, error) {
+	a := &attachments{
+		path:     path,
+		byVolume: make(map[string][]*attachment),
+	}
+	atts := []*attachment{}
+	if err := readJSONFile(path, &atts); err != nil {
+		return nil, err
+	}
+	for _, att := range atts {
+		a.byVolume[att.VolumeID] = append(a.byVolume[att.VolumeID], att)
+	}
+	return a, nil
+}
+
+// attach records att, unless it conflicts with the other attachments of the
+// volume. Attaching again to the same node with the same options returns the
+// existing attachment.
+func (a *attachments) attach(att *attachment) (*attachment, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, o := range a.byVolume[att.VolumeID] {
+		if o.NodeID == att.NodeID {
+			if o.Readonly != att.Readonly || o.AccessMode != att.AccessMode {
+				return nil, status.Errorf(codes.AlreadyExists, "volume %s is already attached to node %s with incompatible options", att.VolumeID, att.NodeID)
+			}
+			return o, nil
+		}
+		if singleNode(att.AccessMode) || singleNode(o.AccessMode) {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is already attached to node %s", att.VolumeID, o.NodeID)
+		}
+		if !att.Readonly && !o.Readonly && (singleWriterMode(att.AccessMode) || singleWriterMode(o.AccessMode)) {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s is already attached writable to node %s", att.VolumeID, o.NodeID)
+		}
+	}
+	a.byVolume[att.VolumeID] = append(a.byVolume[att.VolumeID], att)
+	return att, a.save()
+}
+
+// detach removes the attachment of volumeID to nodeID, or to any node if
+// nodeID is empty.
+func (a *attachments) detach(volumeID, nodeID string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	kept := []*attachment{}
+	for _, o := range a.byVolume[volumeID] {
+		if nodeID != "" && o.NodeID != nodeID {
+			kept = append(kept, o)
+		}
+	}
+	if len(kept) == len(a.byVolume[volumeID]) {
+		return nil
+	}
+	if len(kept) == 0 {
+		delete(a.byVolume, volumeID)
+	} else {
+		a.byVolume[volumeID] = kept
+	}
+	return a.save()
+}
+
+// of returns the attachments of volumeID.
+func (a *attachments) of(volumeID string) []*attachment {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return slices.Clone(a.byVolume[volumeID])
+}
+
+// save persists the attachments, must be called with mu held.
+func (a *attachments) save() error {
+	atts := []*attachment{}
+	for _, v := range a.byVolume {
+		atts = append(atts, v...)
+	}
+	return writeJSONFile(a.path, atts)
+}
+
+// mirrorAttachments writes atts, the attachments of volumeID, to the
+// remote path of the volume.
+func (d *driver) mirrorAttachments(ctx context.Context, volumeID, path string, atts []*attachment) error {
+	return d.writeRemoteJSON(ctx, fmt.Sprintf("%s:%s", volumeID, path), attachmentsFile, atts)
+}
+
+// verifyPublishContext checks that the controller attached the volume to
+// this node, with options allowing the publication.
+func (d *driver) verifyPublishContext(ctx context.Context, pub *publication, path string, publishContext map[string]string) error {
+	nodeID, ok := publishContext[publishNodeKey]
+	if !ok {
+		return status.Errorf(codes.FailedPrecondition, "volume %s was not attached to the node by the controller", pub.VolumeID)
+	}
+	if nodeID != d.config.NodeID {
+		return status.Errorf(codes.FailedPrecondition, "volume %s is attached to node %s, not %s", pub.VolumeID, nodeID, d.config.NodeID)
+	}
+	if publishContext[publishReadonlyKey] == "true" && !pub.Readonly {
+		return status.Errorf(codes.FailedPrecondition, "volume %s is attached readonly to the node", pub.VolumeID)
+	}
+	// the publish context of a previous attachment may be replayed
+	atts := []*attachment{}
+	if _, err := d.readRemoteJSON(ctx, fmt.Sprintf("%s:%s", pub.Remote, path), attachmentsFile, &atts); err != nil {
+		return err
+	}
+	id := publishContext[publishAttachmentKey]
+	for _, att := range atts {
+		if att.ID == id && att.NodeID == d.config.NodeID {
+			return nil
+		}
+	}
+	return status.Errorf(codes.FailedPrecondition, "volume %s: attachment %q of the publish context is not current", pub.VolumeID, id)
+}
+
+// singleNode tells whether mode restricts the volume to one node.
+func singleNode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
+		return true
+	}
+	return false
+}
+
+// singleWriterMode tells whether mode allows only one writer across nodes.
+func singleWriterMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode != csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+}
@@ -0,0 +1,147 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// rcBackend executes rclone remote control methods.
+type rcBackend interface {
+	// Call runs method with json encoded input, and returns the json encoded
+	// output with a http like status code.
+	Call(ctx context.Context, method string, in []byte) ([]byte, int, error)
+	// Ready returns why the backend can not serve calls, if any.
+	Ready() error
+	// Stop shuts the backend down.
+	Stop() error
+}
+
+// rcdBackend talks to a supervised rclone rcd over http.
+type rcdBackend struct {
+	sup    *rcdSupervisor
+	url    string
+	client *http.Client
+}
+
+// newRcdBackend starts rcd listening on addr, either host:port or
+// unix:///path/to/socket, logging its output to l.
+func newRcdBackend(l *slog.Logger, addr string, args []string) (*rcdBackend, error) {
+	return newRcloneBackend(l, addr, "", append([]string{"rcd"}, args...))
+}
+
+// newRcloneBackend starts rclone with args, and with rc listening on addr.
+// If pidfile is set, it records the pid of rclone, and the rclone left
+// behind by a previous run of the driver is stopped first.
+func newRcloneBackend(l *slog.Logger, addr, pidfile string, args []string) (*rcdBackend, error) {
+	if args[0] != "rcd" {
+		// rcd refuses --rc, which other commands need
+		args = append(args, "--rc")
+	}
+	args = append(args, "--rc-no-auth", "--rc-addr", addr, "--log-level=INFO", "--use-json-log")
+	b := &rcdBackend{
+		sup:    newRcdSupervisor(l, args),
+		url:    "http://" + addr,
+		client: http.DefaultClient,
+	}
+	b.sup.pidfile = pidfile
+	if socket, ok := strings.CutPrefix(addr, "unix://"); ok {
+		// a socket left behind by a killed rcd would fail the listen
+		b.sup.prepare = func() error {
+			if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			return nil
+		}
+		b.url = "http://rcd"
+		b.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		}
+	}
+	return b, b.sup.Start()
+}
+
+func (b *rcdBackend) Call(ctx context.Context, method string, in []byte) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s", b.url, method), bytes.NewReader(in))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	out, err := io.ReadAll(resp.Body)
+	return out, resp.StatusCode, err
+}
+
+func (b *rcdBackend) Ready() error {
+	if running, lastErr, _ := b.sup.State(); !running {
+		return fmt.Errorf("rcd is not running: %v", lastErr)
+	}
+	return nil
+}
+
+func (b *rcdBackend) Stop() error {
+	return b.sup.Stop(func() error {
+		_, _, err := b.Call(context.Background(), "core/quit", []byte("{}"))
+		return err
+	}, 5*time.Second)
+}
+
+// remoteOnlyBackend restricts a backend to operations on remotes. It is
+// used by the controller, which runs without FUSE and must never mount.
+type remoteOnlyBackend struct {
+	rcBackend
+}
+
+var mountMethods = []string{"mount/", "vfs/", "serve/"}
+
+func (b remoteOnlyBackend) Call(ctx context.Context, method string, in []byte) ([]byte, int, error) {
+	for _, p := range mountMethods {
+		if strings.HasPrefix(method, p) {
+			return nil, 0, fmt.Errorf("%s is not available in controller mode", method)
+		}
+	}
+	return b.rcBackend.Call(ctx, method, in)
+}
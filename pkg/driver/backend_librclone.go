@@ -0,0 +1,125 @@
+//go:build librclone
+
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/rclone/rclone/fs"
+	"github.com/rclone/rclone/fs/config"
+	"github.com/rclone/rclone/fs/rc"
+	"github.com/rclone/rclone/fs/rc/jobs"
+	"github.com/rclone/rclone/librclone/librclone"
+	"golang.org/x/net/context"
+
+	// backends and rc methods linked into the driver
+	_ "github.com/rclone/rclone/backend/all"
+	_ "github.com/rclone/rclone/cmd/mount"
+	_ "github.com/rclone/rclone/fs/operations"
+	_ "github.com/rclone/rclone/fs/sync"
+)
+
+const embeddedRclone = true
+
+// embeddedBackend runs rc methods in process against the linked rclone.
+type embeddedBackend struct{}
+
+func newEmbeddedBackend(cfg Config) (rcBackend, error) {
+	if cfg.RcloneConfig != "" {
+		if err := config.SetConfigPath(cfg.RcloneConfig); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.SetCacheDir(cfg.CacheDir); err != nil {
+		return nil, err
+	}
+	librclone.Initialize()
+
+	l := slog.Default().With("component", "rclone")
+	fs.LogPrint = func(level fs.LogLevel, text string) {
+		l.Log(context.Background(), rcloneLevel(level.String()), text)
+	}
+	fs.GetConfig(context.Background()).LogLevel = fs.LogLevelInfo
+	return embeddedBackend{}, nil
+}
+
+// Call returns the errors of rc methods as is, instead of a json body, so
+// that they can be inspected with errors.Is and errors.As.
+func (embeddedBackend) Call(ctx context.Context, method string, in []byte) ([]byte, int, error) {
+	params := rc.Params{}
+	if len(in) > 0 {
+		if err := json.Unmarshal(in, &params); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+
+	call := rc.Calls.Get(method)
+	if call == nil {
+		return nil, http.StatusNotFound, fmt.Errorf("couldn't find method %q", method)
+	}
+	if call.NeedsRequest || call.NeedsResponse {
+		return nil, http.StatusNotFound, fmt.Errorf("method %q needs a http request, not supported", method)
+	}
+
+	_, out, err := jobs.NewJob(ctx, call.Fn, params)
+	if err != nil {
+		_, status := rc.Error(method, params, err, http.StatusInternalServerError)
+		return nil, status, &rcError{method: method, status: status, err: err}
+	}
+	if out == nil {
+		out = rc.Params{}
+	}
+	b, err := json.Marshal(out)
+	return b, http.StatusOK, err
+}
+
+func (embeddedBackend) Ready() error {
+	return nil
+}
+
+func (embeddedBackend) Stop() error {
+	librclone.Finalize()
+	return nil
+}
+
+// rcError is a failed in process rc call.
+type rcError struct {
+	method string
+	status int
+	err    error
+}
+
+func (e *rcError) Error() string {
+	return secrets.String(fmt.Sprintf("%d: %s: %v", e.status, e.method, e.err))
+}
+
+func (e *rcError) Unwrap() error {
+	return e.err
+}
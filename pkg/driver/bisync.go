@@ -0,0 +1,141 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// conflict policies of bisync volumes, besides local and remote. By
+// default both versions are kept, renamed with a suffix.
+const (
+	conflictKeep    = "keep"
+	conflictNewer   = "newer"
+	conflictOlder   = "older"
+	conflictLarger  = "larger"
+	conflictSmaller = "smaller"
+)
+
+// defaultBisyncInterval is the sync interval of bisync volumes, which are
+// meant to be synchronized while mounted.
+const defaultBisyncInterval = 5 * time.Minute
+
+// minConflictResolveVersion is the first rclone resolving bisync conflicts.
+var minConflictResolveVersion = [3]int{1, 66, 0}
+
+// bisyncOptions parses the options of a bisync volume.
+func bisyncOptions(volumeContext map[string]string) (*copyOptions, error) {
+	opts := &copyOptions{Bisync: true, Conflict: conflictKeep, Interval: defaultBisyncInterval}
+	if _, ok := volumeContext[syncBackKey]; ok {
+		return nil, fmt.Errorf("%s is not supported by %s=%s", syncBackKey, mounterKey, mounterBisync)
+	}
+	if v, ok := volumeContext[conflictKey]; ok {
+		if !validBisyncConflict(v) {
+			return nil, fmt.Errorf("invalid %s %q, must be %s, %s, %s, %s, %s, %s or %s", conflictKey, v, conflictKeep, conflictLocal, conflictRemote, conflictNewer, conflictOlder, conflictLarger, conflictSmaller)
+		}
+		opts.Conflict = v
+	}
+	if v, ok := volumeContext[syncIntervalKey]; ok {
+		var err error
+		if opts.Interval, err = time.ParseDuration(v); err != nil || opts.Interval <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", syncIntervalKey, v)
+		}
+	}
+	return opts, nil
+}
+
+func validBisyncConflict(v string) bool {
+	switch v {
+	case conflictKeep, conflictLocal, conflictRemote, conflictNewer, conflictOlder, conflictLarger, conflictSmaller:
+		return true
+	}
+	return false
+}
+
+// bisyncWorkdir keeps the listings of bisync between runs.
+func (d *driver) bisyncWorkdir(pub *publication) string {
+	return filepath.Join(d.config.StateDir, "bisync", pub.id())
+}
+
+// bisyncResynced exists once the first resync of pub succeeded, bisync has
+// the listings of both sides from then on.
+func (d *driver) bisyncResynced(pub *publication) string {
+	return filepath.Join(d.bisyncWorkdir(pub), "resynced")
+}
+
+// bisync synchronizes the local copy of pub and the remote both ways. The
+// first run must resync, which makes the union of both sides. Later runs
+// fail if bisync lost track of the sides, until resynced explicitly, as
+// resyncing may bring back deleted files.
+func (d *driver) bisync(ctx context.Context, pub *publication, resync bool) error {
+	if !d.feature("bisync volumes", "sync/bisync") {
+		return status.Errorf(codes.FailedPrecondition, "rclone %s does not support bisync", d.rclone.Version)
+	}
+	workdir := d.bisyncWorkdir(pub)
+	if err := os.MkdirAll(workdir, 0700); err != nil {
+		return err
+	}
+	filters := filepath.Join(workdir, "filters.txt")
+	if err := os.WriteFile(filters, []byte("- /"+leaseFile+"\n"), 0600); err != nil {
+		return err
+	}
+	params := map[string]any{
+		"path1":              d.copyDir(pub),
+		"path2":              fmt.Sprintf("%s:%s", pub.Remote, pub.RemotePath),
+		"workdir":            workdir,
+		"filtersFile":        filters,
+		"resync":             resync,
+		"createEmptySrcDirs": true,
+	}
+	switch pub.Copy.Conflict {
+	case conflictKeep:
+	case conflictLocal, conflictRemote:
+		params["conflictResolve"] = map[string]string{conflictLocal: "path1", conflictRemote: "path2"}[pub.Copy.Conflict]
+	default:
+		params["conflictResolve"] = pub.Copy.Conflict
+	}
+	if _, ok := params["conflictResolve"]; ok && !d.rclone.atLeast(minConflictResolveVersion) {
+		return status.Errorf(codes.InvalidArgument, "%s %s requires rclone v%d.%d.%d", conflictKey, pub.Copy.Conflict, minConflictResolveVersion[0], minConflictResolveVersion[1], minConflictResolveVersion[2])
+	}
+
+	start := time.Now()
+	if _, err := d.rcTarget(ctx, pub.TargetPath, "sync/bisync", params); err != nil {
+		return status.Errorf(codes.Unavailable, "bisync failed: %s", err)
+	}
+	if resync {
+		if err := os.WriteFile(d.bisyncResynced(pub), nil, 0600); err != nil {
+			return err
+		}
+	}
+	logFrom(ctx).Info("synchronized volume", "resync", resync, "duration", time.Since(start))
+	return nil
+}
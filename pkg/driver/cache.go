@@ -0,0 +1,200 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Volume context keys of the VFS cache, sizes accept binary suffixes like
+// "10G".
+const (
+	cacheMaxSizeKey      = "cacheMaxSize"
+	cacheMinFreeSpaceKey = "cacheMinFreeSpace"
+	keepCacheKey         = "keepCache"
+)
+
+// minFreeSpaceVersion is the first rclone with the CacheMinFreeSpace option.
+var minFreeSpaceVersion = [3]int{1, 64, 0}
+
+const (
+	uploadsPollInterval = time.Second
+	uploadsTimeout      = 5 * time.Minute
+)
+
+// ParseSize parses sizes like "512M" or "10G", in bytes, with binary
+// suffixes B, K, M, G, T and P.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+	shift := 0
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "B":
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	case "T":
+		shift = 40
+	case "P":
+		shift = 50
+	default:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err == nil && n < 0 {
+			err = errors.New("negative size")
+		}
+		return n, err
+	}
+	f, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if err != nil {
+		return 0, err
+	}
+	if f < 0 {
+		return 0, errors.New("negative size")
+	}
+	return int64(f * float64(int64(1)<<shift)), nil
+}
+
+// cacheOptions sets the VFS cache options of pub from volumeContext, and
+// the defaults of the driver.
+func (d *driver) cacheOptions(pub *publication, volumeContext map[string]string, vfsOpt map[string]any) error {
+	pub.CacheMaxSize = d.config.CacheVolumeSize
+	if v, ok := volumeContext[cacheMaxSizeKey]; ok {
+		n, err := ParseSize(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", cacheMaxSizeKey, v, err)
+		}
+		pub.CacheMaxSize = n
+	}
+	if d.config.CacheMaxSize > 0 && pub.CacheMaxSize <= 0 {
+		return fmt.Errorf("%s is required, the node cache is limited to %d bytes", cacheMaxSizeKey, d.config.CacheMaxSize)
+	}
+	if pub.CacheMaxSize > 0 {
+		vfsOpt["CacheMaxSize"] = pub.CacheMaxSize
+	}
+
+	minFree := d.config.CacheMinFreeSpace
+	if v, ok := volumeContext[cacheMinFreeSpaceKey]; ok {
+		n, err := ParseSize(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", cacheMinFreeSpaceKey, v, err)
+		}
+		minFree = n
+	}
+	if minFree > 0 {
+		if !d.rclone.atLeast(minFreeSpaceVersion) {
+			return fmt.Errorf("%s requires rclone v%d.%d.%d", cacheMinFreeSpaceKey, minFreeSpaceVersion[0], minFreeSpaceVersion[1], minFreeSpaceVersion[2])
+		}
+		vfsOpt["CacheMinFreeSpace"] = minFree
+	}
+
+	if v, ok := volumeContext[keepCacheKey]; ok {
+		keep, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", keepCacheKey, v, err)
+		}
+		pub.KeepCache = keep
+	}
+	return nil
+}
+
+// cacheBudget refuses pub if the caches of the node would exceed the node
+// budget. Publications of the same remote share their cache.
+func (d *driver) cacheBudget(pub *publication) func(others []*publication) error {
+	return func(others []*publication) error {
+		if d.config.CacheMaxSize <= 0 {
+			return nil
+		}
+		sizes := map[string]int64{pub.Remote: pub.CacheMaxSize}
+		for _, o := range others {
+			if o.CacheMaxSize > sizes[o.Remote] {
+				sizes[o.Remote] = o.CacheMaxSize
+			}
+		}
+		var total int64
+		for _, n := range sizes {
+			total += n
+		}
+		if total > d.config.CacheMaxSize {
+			return status.Errorf(codes.ResourceExhausted, "volume caches would use %d bytes, the node cache is limited to %d bytes", total, d.config.CacheMaxSize)
+		}
+		return nil
+	}
+}
+
+// dropsCache tells if the cache of pub goes away with its publication.
+func (d *driver) dropsCache(pub *publication) bool {
+	return pub.Ephemeral || (!pub.KeepCache && !d.publications.shared(pub))
+}
+
+// waitUploads waits until the VFS of pub has no pending uploads, so that
+// dropping its cache loses no writes.
+func (d *driver) waitUploads(ctx context.Context, pub *publication) error {
+	ctx, cancel := context.WithTimeout(ctx, uploadsTimeout)
+	defer cancel()
+	fs := fmt.Sprintf("%s:%s", pub.Remote, pub.RemotePath)
+	for {
+		res, err := d.rcTarget(ctx, pub.TargetPath, "vfs/stats", map[string]any{"fs": fs})
+		if err != nil {
+			if strings.Contains(err.Error(), "no VFS found") {
+				return nil
+			}
+			return err
+		}
+		pending := res.Get("diskCache.uploadsInProgress").Int() + res.Get("diskCache.uploadsQueued").Int()
+		if pending == 0 {
+			return nil
+		}
+		logFrom(ctx).Info("waiting for uploads", "fs", fs, "pending", pending)
+		select {
+		case <-ctx.Done():
+			return status.Errorf(codes.Unavailable, "%d uploads of %s are still pending", pending, fs)
+		case <-time.After(uploadsPollInterval):
+		}
+	}
+}
+
+// removeCache deletes the VFS cache of remote.
+func (d *driver) removeCache(remote string) error {
+	var errs []error
+	for _, dir := range []string{"vfs", "vfsMeta"} {
+		errs = append(errs, os.RemoveAll(filepath.Join(d.config.CacheDir, dir, remote)))
+	}
+	return errors.Join(errs...)
+}
@@ -30,20 +30,21 @@ import (
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func (d *driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
 	vols := &csi.ListVolumesResponse{
 		Entries: []*csi.ListVolumesResponse_Entry{},
 	}
-	rs, err := d.remoteList()
+	rs, err := d.remoteList(ctx)
 	if err != nil {
 		return nil, err
 	}
 	for _, r := range rs {
-		ri, err := d.remoteAbout(r, "")
+		ri, err := d.remoteAbout(ctx, r, "")
 		if err != nil {
 			return nil, err
 		}
@@ -54,12 +55,12 @@ func (d *driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 			},
 		})
 	}
-	glog.V(5).Infof("Volumes are: %+v", *vols)
+	logFrom(ctx).Debug("list volumes", "volumes", len(vols.Entries))
 	return vols, nil
 }
 
 func (d *driver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	ri, err := d.remoteAbout(req.VolumeId, "")
+	ri, err := d.remoteAbout(ctx, req.VolumeId, "")
 	if err != nil {
 		return nil, err
 	}
@@ -70,7 +71,7 @@ func (d *driver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGet
 		},
 		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{},
 	}
-	glog.V(5).Infof("Volume is: %+v", *vol)
+	logFrom(ctx).Debug("get volume", "capacity", vol.Volume.CapacityBytes)
 	return vol, nil
 }
 
@@ -78,6 +79,8 @@ func (d *driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 	supportedModes := []csi.VolumeCapability_AccessMode_Mode{
 		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
 		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
 		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
 		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
 	}
@@ -85,11 +88,11 @@ func (d *driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 	var err error
 	msg := &strings.Builder{}
 
-	if _, err = d.remoteCreate(req.VolumeId, req.VolumeContext["parameters"]); err != nil {
+	if _, err = d.remoteCreate(ctx, req.VolumeId, req.VolumeContext["parameters"]); err != nil {
 		fmt.Fprintf(msg, "%+v", err)
 		goto clean
 	}
-	if _, err = d.remoteAbout(req.VolumeId, "/"); err != nil {
+	if _, err = d.remoteAbout(ctx, req.VolumeId, "/"); err != nil {
 		fmt.Fprintf(msg, "%+v", err)
 		goto clean
 	}
@@ -106,12 +109,23 @@ func (d *driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 				found = true
 			}
 		}
+		if mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
+			if err := checkMultiWriter(req.VolumeContext); err != nil {
+				fmt.Fprintf(msg, "[%s]: %s\n", req.VolumeId, err)
+				continue
+			}
+			found = true
+		}
 		if !found {
 			fmt.Fprintf(msg, "[%s]: unsupported AccessMode %s\n", req.VolumeId, c.AccessMode.Mode)
 			continue
 		}
 	}
 	if msg.Len() == 0 {
+		// multi writer is opt in, only confirmed for acknowledged volumes
+		if checkMultiWriter(req.VolumeContext) == nil {
+			supportedModes = append(supportedModes, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)
+		}
 		caps := []*csi.VolumeCapability{}
 		for _, m := range supportedModes {
 			caps = append(caps, &csi.VolumeCapability{
@@ -130,6 +144,12 @@ func (d *driver) ControllerGetCapabilities(context.Context, *csi.ControllerGetCa
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		csi.ControllerServiceCapability_RPC_GET_VOLUME,
 	}
+	if d.config.Attach {
+		cl = append(cl,
+			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+			csi.ControllerServiceCapability_RPC_PUBLISH_READONLY,
+		)
+	}
 	var caps []*csi.ControllerServiceCapability
 	for _, c := range cl {
 		caps = append(caps, &csi.ControllerServiceCapability{
@@ -144,11 +164,68 @@ func (d *driver) ControllerGetCapabilities(context.Context, *csi.ControllerGetCa
 }
 
 func (d *driver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	return nil, errors.New("not supported")
+	if !d.config.Attach {
+		return nil, status.Error(codes.Unimplemented, "attachments are disabled, see -attach")
+	}
+	if req.VolumeId == "" || req.NodeId == "" || req.VolumeCapability == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume id, node id and volume capability are required")
+	}
+	att := &attachment{
+		ID:         randomID(),
+		VolumeID:   req.VolumeId,
+		NodeID:     req.NodeId,
+		AccessMode: req.VolumeCapability.GetAccessMode().GetMode(),
+		Path:       "/",
+	}
+	att.Readonly = req.Readonly || readerOnly(att.AccessMode)
+	if v, ok := req.VolumeContext["path"]; ok {
+		att.Path = v
+	}
+	if _, err := d.remoteCreate(ctx, req.VolumeId, req.VolumeContext["parameters"]); err != nil {
+		return nil, err
+	}
+	got, err := d.attachments.attach(att)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.mirrorAttachments(ctx, req.VolumeId, att.Path, d.attachments.of(req.VolumeId)); err != nil {
+		if got == att {
+			err = errors.Join(err, d.attachments.detach(req.VolumeId, req.NodeId))
+		}
+		return nil, status.Errorf(codes.Unavailable, "failed to record the attachment on the remote: %s", err)
+	}
+	att = got
+	logFrom(ctx).Info("attached volume", "node_id", att.NodeID, "attachment_id", att.ID, "readonly", att.Readonly)
+	return &csi.ControllerPublishVolumeResponse{PublishContext: att.publishContext()}, nil
 }
 
-func (hp *driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	return nil, errors.New("not supported")
+func (d *driver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if !d.config.Attach {
+		return nil, status.Error(codes.Unimplemented, "attachments are disabled, see -attach")
+	}
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+	atts := d.attachments.of(req.VolumeId)
+	if len(atts) == 0 {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	// first on the remote, so that nodes do not publish with the context
+	// of a forgotten attachment
+	kept := []*attachment{}
+	for _, att := range atts {
+		if req.NodeId != "" && att.NodeID != req.NodeId {
+			kept = append(kept, att)
+		}
+	}
+	if err := d.mirrorAttachments(ctx, req.VolumeId, atts[0].Path, kept); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to remove the attachment from the remote: %s", err)
+	}
+	if err := d.attachments.detach(req.VolumeId, req.NodeId); err != nil {
+		return nil, err
+	}
+	logFrom(ctx).Info("detached volume", "node_id", req.NodeId)
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
 func (d *driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
@@ -0,0 +1,671 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Volume context keys of copy volumes. Copy volumes are downloaded into a
+// local directory, which is bind mounted to the target, and uploaded back
+// on unpublish, and every syncInterval if set. Bisync volumes are
+// synchronized both ways instead.
+const (
+	syncBackKey     = "syncBack"
+	syncIntervalKey = "syncInterval"
+	conflictKey     = "conflict"
+)
+
+// syncBack modes: copy never deletes remote files, sync also deletes the
+// files removed from the local copy.
+const (
+	syncBackCopy = "copy"
+	syncBackSync = "sync"
+)
+
+// conflict policies, for files changed both locally and on the remote
+// since the local copy was made.
+const (
+	conflictFail   = "fail"
+	conflictLocal  = "local"
+	conflictRemote = "remote"
+)
+
+// maxReportedConflicts limits the conflicting files listed in errors.
+const maxReportedConflicts = 10
+
+// copyOptions configures a copy or bisync volume.
+type copyOptions struct {
+	Bisync   bool          `json:"bisync,omitempty"`
+	SyncBack string        `json:"syncBack,omitempty"`
+	Conflict string        `json:"conflict"`
+	Interval time.Duration `json:"interval,omitempty"`
+}
+
+// parseCopyOptions parses the options of a copy volume.
+func parseCopyOptions(volumeContext map[string]string) (opts *copyOptions, err error) {
+	opts = &copyOptions{SyncBack: syncBackCopy, Conflict: conflictFail}
+	if v, ok := volumeContext[syncBackKey]; ok {
+		if v != syncBackCopy && v != syncBackSync {
+			return nil, fmt.Errorf("invalid %s %q, must be %s or %s", syncBackKey, v, syncBackCopy, syncBackSync)
+		}
+		opts.SyncBack = v
+	}
+	if v, ok := volumeContext[conflictKey]; ok {
+		if v != conflictFail && v != conflictLocal && v != conflictRemote {
+			return nil, fmt.Errorf("invalid %s %q, must be %s, %s or %s", conflictKey, v, conflictFail, conflictLocal, conflictRemote)
+		}
+		opts.Conflict = v
+	}
+	if v, ok := volumeContext[syncIntervalKey]; ok {
+		if opts.Interval, err = time.ParseDuration(v); err != nil || opts.Interval <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", syncIntervalKey, v)
+		}
+	}
+	return opts, nil
+}
+
+// fileState is what tells whether a file changed.
+type fileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// copySnapshot records the files of both sides after the last transfer,
+// to tell apart the changes of the workload and the ones of the remote.
+type copySnapshot struct {
+	Remote map[string]fileState `json:"remote"`
+	Local  map[string]fileState `json:"local"`
+}
+
+// copyDir is the local copy of pub.
+func (d *driver) copyDir(pub *publication) string {
+	return filepath.Join(d.config.CacheDir, "copies", pub.id())
+}
+
+func (d *driver) copySnapshotPath(pub *publication) string {
+	return filepath.Join(d.config.StateDir, "copies", pub.id()+".json")
+}
+
+// copyLocks are the locks of copies by target path. They stay in the map
+// once made, deleting them would let a waiter and a later caller each hold
+// a lock of their own.
+var copyLocks sync.Map
+
+// lockCopy serializes the transfers of the copy of pub.
+func lockCopy(pub *publication) func() {
+	v, _ := copyLocks.LoadOrStore(pub.TargetPath, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// copyMounter mounts local copies of volumes, see copyPublish.
+type copyMounter struct {
+	d *driver
+}
+
+func (m copyMounter) Mount(ctx context.Context, pub *publication, vfsOpt, mountOpt map[string]any) error {
+	return m.d.copyPublish(ctx, pub, vfsOpt)
+}
+
+func (m copyMounter) Unmount(ctx context.Context, pub *publication) error {
+	return m.d.copyUnpublish(ctx, pub)
+}
+
+func (m copyMounter) IsMounted(pub *publication) (bool, error) {
+	return m.d.copyMount().IsMounted(pub)
+}
+
+func (m copyMounter) Stats(ctx context.Context, pub *publication) ([]*csi.VolumeUsage, error) {
+	return m.d.copyMount().Stats(ctx, pub)
+}
+
+func (m copyMounter) Ready() error {
+	return m.d.copyMount().Ready()
+}
+
+// copyMount bind mounts local copies to their target.
+func (d *driver) copyMount() bindMounter {
+	return bindMounter{Source: d.copyDir, Timeout: d.config.HealthTimeout}
+}
+
+// copyPublish downloads the remote path of pub into its local copy, and
+// bind mounts it to the target.
+func (d *driver) copyPublish(ctx context.Context, pub *publication, vfsOpt map[string]any) (err error) {
+	unlock := lockCopy(pub)
+	defer unlock()
+
+	dir := d.copyDir(pub)
+	if _, e := os.Stat(d.copyStatePath(pub)); e == nil {
+		// published already, or uploading failed on unpublish, downloading
+		// again would overwrite the changes of the workload
+		var ok bool
+		if ok, err = d.copyMount().IsMounted(pub); err != nil {
+			return err
+		}
+		if !ok {
+			logFrom(ctx).Warn("resuming local copy of a previous publication, which is not uploaded yet", "dir", dir)
+			if err = d.copyMount().Mount(ctx, pub, nil, nil); err != nil {
+				return err
+			}
+		}
+		if pub.Copy.Interval > 0 && !pub.Readonly {
+			d.startSyncing(pub)
+		}
+		return nil
+	}
+	defer func() {
+		if err != nil {
+			if e := d.removeCopy(pub); e != nil {
+				logFrom(ctx).Error("failed to remove local copy", "err", e)
+			}
+		}
+	}()
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(d.copySnapshotPath(pub)), 0700); err != nil {
+		return err
+	}
+	if pub.Copy.Bisync {
+		err = d.bisync(ctx, pub, true)
+	} else {
+		err = d.copyIn(ctx, pub)
+	}
+	if err != nil {
+		return err
+	}
+	if err = chownTree(dir, vfsOpt); err != nil {
+		return err
+	}
+
+	if err = d.copyMount().Mount(ctx, pub, nil, nil); err != nil {
+		return err
+	}
+	if pub.Copy.Interval > 0 && !pub.Readonly {
+		d.startSyncing(pub)
+	}
+	return nil
+}
+
+// copyIn downloads the remote path of pub into its local copy, and records
+// the files of both sides.
+func (d *driver) copyIn(ctx context.Context, pub *publication) (err error) {
+	dir := d.copyDir(pub)
+	start := time.Now()
+	_, err = d.rcTarget(ctx, pub.TargetPath, "sync/copy", map[string]any{
+		"srcFs":              fmt.Sprintf("%s:%s", pub.Remote, pub.RemotePath),
+		"dstFs":              dir,
+		"createEmptySrcDirs": true,
+		"_filter":            map[string]any{"ExcludeRule": []string{"/" + leaseFile}},
+	})
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "failed to download volume: %s", err)
+	}
+	snap := &copySnapshot{}
+	if snap.Remote, err = d.listRemote(ctx, pub); err != nil {
+		return err
+	}
+	if snap.Local, err = listLocal(dir); err != nil {
+		return err
+	}
+	if err = writeJSONFile(d.copySnapshotPath(pub), snap); err != nil {
+		return err
+	}
+	logFrom(ctx).Info("downloaded volume", "files", len(snap.Local), "duration", time.Since(start))
+	return nil
+}
+
+// copyUnpublish unmounts the local copy of pub, uploads its changes and
+// removes it. The local copy is kept if uploading fails, so that the
+// next call retries.
+func (d *driver) copyUnpublish(ctx context.Context, pub *publication) error {
+	d.syncs.stop(pub.TargetPath)
+	unlock := lockCopy(pub)
+	defer unlock()
+	if err := d.copyMount().Unmount(ctx, pub); err != nil {
+		return err
+	}
+	if !pub.Readonly {
+		if err := d.syncBack(ctx, pub, true); err != nil {
+			return err
+		}
+	}
+	return d.removeCopy(pub)
+}
+
+// syncBack transfers the changes of the local copy of pub to the remote,
+// final is set for the last sync on unpublish. The caller holds the lock
+// of the copy.
+func (d *driver) syncBack(ctx context.Context, pub *publication, final bool) error {
+	// the last sync may take a lease back, as the local copy is gone after
+	if err := d.holdLease(ctx, pub, final); err != nil {
+		return err
+	}
+	if pub.Copy.Bisync {
+		return d.bisync(ctx, pub, false)
+	}
+	return d.copyOut(ctx, pub, final)
+}
+
+func (d *driver) removeCopy(pub *publication) error {
+	return errors.Join(
+		os.RemoveAll(d.copyDir(pub)),
+		os.RemoveAll(d.copySnapshotPath(pub)),
+		os.RemoveAll(d.bisyncWorkdir(pub)),
+	)
+}
+
+// copyStatePath exists once the local copy of pub is made, until it is
+// removed.
+func (d *driver) copyStatePath(pub *publication) string {
+	if pub.Copy.Bisync {
+		return d.bisyncResynced(pub)
+	}
+	return d.copySnapshotPath(pub)
+}
+
+// copyOut uploads the files changed in the local copy of pub. Files also
+// changed on the remote are conflicts, handled by the conflict policy of
+// the volume, the remote policy replaces local files by the remote ones
+// unless final. Files which are on the remote as they are locally, e.g.
+// uploaded by an attempt which failed later, are neither uploaded nor
+// conflicts. The snapshot is only updated once everything is transferred,
+// and only for the files transferred or found in sync on the remote.
+func (d *driver) copyOut(ctx context.Context, pub *publication, final bool) error {
+	snap := &copySnapshot{}
+	if err := readJSONFile(d.copySnapshotPath(pub), snap); err != nil {
+		return err
+	}
+	dir := d.copyDir(pub)
+	local, err := listLocal(dir)
+	if err != nil {
+		return err
+	}
+	remote, err := d.listRemote(ctx, pub)
+	if err != nil {
+		return err
+	}
+	precision, err := d.modTimePrecision(ctx, pub)
+	if err != nil {
+		return err
+	}
+
+	plan := planCopyOut(snap, local, remote, precision, pub.Copy)
+	uploads, deletes, downloads, conflicts := plan.uploads, plan.deletes, plan.downloads, plan.conflicts
+	if len(conflicts) > 0 {
+		if pub.Copy.Conflict == conflictFail {
+			shown := conflicts
+			if len(shown) > maxReportedConflicts {
+				shown = shown[:maxReportedConflicts]
+			}
+			return status.Errorf(codes.Aborted, "%d files changed both locally and on the remote, resolve with the %s policy %s or %s: %s", len(conflicts), conflictKey, conflictLocal, conflictRemote, strings.Join(shown, ", "))
+		}
+		logFrom(ctx).Warn("resolved conflicting changes", "policy", pub.Copy.Conflict, "files", conflicts)
+	}
+
+	fs := fmt.Sprintf("%s:%s", pub.Remote, pub.RemotePath)
+	if len(uploads) > 0 {
+		list := d.copySnapshotPath(pub) + ".files"
+		if err := os.WriteFile(list, []byte(strings.Join(uploads, "\n")+"\n"), 0600); err != nil {
+			return err
+		}
+		defer os.Remove(list)
+		_, err := d.rcTarget(ctx, pub.TargetPath, "sync/copy", map[string]any{
+			"srcFs":   dir,
+			"dstFs":   fs,
+			"_filter": map[string]any{"FilesFromRaw": []string{list}},
+		})
+		if err != nil {
+			return status.Errorf(codes.Unavailable, "failed to upload %d files: %s", len(uploads), err)
+		}
+	}
+	for _, p := range deletes {
+		_, err := d.rcTarget(ctx, pub.TargetPath, "operations/deletefile", map[string]any{"fs": fs, "remote": p})
+		if err != nil && !strings.Contains(err.Error(), "not found") {
+			return status.Errorf(codes.Unavailable, "failed to delete %s: %s", p, err)
+		}
+	}
+	// the local copy is removed after the final sync anyway
+	if final {
+		downloads = nil
+	}
+	if len(downloads) > 0 {
+		if err := d.downloadFiles(ctx, pub, downloads, remote); err != nil {
+			return err
+		}
+		if local, err = listLocal(dir); err != nil {
+			return err
+		}
+	}
+	logFrom(ctx).Info("uploaded volume", "uploads", len(uploads), "deletes", len(deletes), "downloads", len(downloads), "conflicts", len(conflicts))
+
+	if len(uploads)+len(deletes)+len(conflicts)+len(plan.synced) == 0 {
+		return nil
+	}
+	if remote, err = d.listRemote(ctx, pub); err != nil {
+		return err
+	}
+	// other changes of the remote are not in the local copy, they must
+	// still be told apart from the ones of the workload
+	seen := append(append(append(uploads, deletes...), downloads...), plan.synced...)
+	return writeJSONFile(d.copySnapshotPath(pub), &copySnapshot{
+		Remote: advanceFiles(snap.Remote, remote, seen),
+		Local:  local,
+	})
+}
+
+// copyOutPlan is what copyOut transfers, by path.
+type copyOutPlan struct {
+	uploads, deletes, downloads []string
+	// conflicts changed on both sides, synced are the same on both
+	conflicts, synced []string
+}
+
+// planCopyOut sorts the files changed in the local copy since snap by how
+// copyOut handles them, with the options of opts. Files changed on the
+// remote since snap as well are conflicts, downloaded with the remote
+// policy and uploaded with the local one.
+func planCopyOut(snap *copySnapshot, local, remote map[string]fileState, precision time.Duration, opts *copyOptions) *copyOutPlan {
+	plan := &copyOutPlan{}
+	for _, p := range changedFiles(snap.Local, local) {
+		if sameFile(local, remote, p, precision) {
+			plan.synced = append(plan.synced, p)
+			continue
+		}
+		if changed(snap.Remote, remote, p) {
+			plan.conflicts = append(plan.conflicts, p)
+			if opts.Conflict == conflictRemote {
+				plan.downloads = append(plan.downloads, p)
+			}
+			if opts.Conflict != conflictLocal {
+				continue
+			}
+		}
+		if _, ok := local[p]; ok {
+			plan.uploads = append(plan.uploads, p)
+		} else if opts.SyncBack == syncBackSync {
+			plan.deletes = append(plan.deletes, p)
+		}
+	}
+	return plan
+}
+
+// advanceFiles returns before with the files of paths as they are in after.
+func advanceFiles(before, after map[string]fileState, paths []string) map[string]fileState {
+	files := maps.Clone(before)
+	if files == nil {
+		files = map[string]fileState{}
+	}
+	for _, p := range paths {
+		if st, ok := after[p]; ok {
+			files[p] = st
+		} else {
+			delete(files, p)
+		}
+	}
+	return files
+}
+
+// downloadFiles replaces files of the local copy of pub by their version
+// in remote, the listing of the remote, keeping the ownership of the local
+// files. Files missing from the remote are removed.
+func (d *driver) downloadFiles(ctx context.Context, pub *publication, files []string, remote map[string]fileState) error {
+	dir := d.copyDir(pub)
+	owners := map[string]*syscall.Stat_t{}
+	var fetch []string
+	for _, p := range files {
+		local := filepath.Join(dir, filepath.FromSlash(p))
+		if info, err := os.Lstat(local); err == nil {
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				owners[p] = st
+			}
+		}
+		if _, ok := remote[p]; ok {
+			fetch = append(fetch, p)
+		} else if err := os.Remove(local); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if len(fetch) == 0 {
+		return nil
+	}
+	list := d.copySnapshotPath(pub) + ".downloads"
+	if err := os.WriteFile(list, []byte(strings.Join(fetch, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+	defer os.Remove(list)
+	_, err := d.rcTarget(ctx, pub.TargetPath, "sync/copy", map[string]any{
+		"srcFs":   fmt.Sprintf("%s:%s", pub.Remote, pub.RemotePath),
+		"dstFs":   dir,
+		"_filter": map[string]any{"FilesFromRaw": []string{list}},
+	})
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "failed to download %d files: %s", len(fetch), err)
+	}
+	for _, p := range fetch {
+		if st, ok := owners[p]; ok {
+			if err := os.Lchown(filepath.Join(dir, filepath.FromSlash(p)), int(st.Uid), int(st.Gid)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// startSyncing transfers the changes of the copy of pub periodically.
+func (d *driver) startSyncing(pub *publication) {
+	d.syncs.start(pub.TargetPath, func(ctx context.Context) {
+		l := slog.Default().With("volume_id", pub.VolumeID, "target_path", pub.TargetPath)
+		ctx = withLogger(ctx, l)
+		t := time.NewTicker(pub.Copy.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			if err := d.periodicSync(ctx, pub); err != nil && ctx.Err() == nil {
+				l.Error("periodic sync failed", "err", err)
+			}
+		}
+	})
+}
+
+func (d *driver) periodicSync(ctx context.Context, pub *publication) error {
+	unlock := lockCopy(pub)
+	defer unlock()
+	// the copy may be unpublished while waiting for the lock
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.syncBack(ctx, pub, false)
+}
+
+// restoreSyncs resumes the periodic syncs of copy volumes published
+// before a restart of the driver.
+func (d *driver) restoreSyncs() {
+	for _, pub := range d.publications.list() {
+		if pub.Copy != nil && pub.Copy.Interval > 0 && !pub.Readonly {
+			d.startSyncing(pub)
+		}
+	}
+}
+
+// listRemote returns the files of the remote path of pub.
+func (d *driver) listRemote(ctx context.Context, pub *publication) (map[string]fileState, error) {
+	res, err := d.rcTarget(ctx, pub.TargetPath, "operations/list", map[string]any{
+		"fs":     fmt.Sprintf("%s:%s", pub.Remote, pub.RemotePath),
+		"remote": "",
+		"opt":    map[string]any{"recurse": true, "filesOnly": true},
+	})
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]fileState{}
+	for _, e := range res.Get("list").Array() {
+		p := e.Get("Path").String()
+		if p == leaseFile {
+			continue
+		}
+		t, _ := time.Parse(time.RFC3339Nano, e.Get("ModTime").String())
+		files[p] = fileState{Size: e.Get("Size").Int(), ModTime: t}
+	}
+	return files, nil
+}
+
+// listLocal returns the files below dir.
+func listLocal(dir string) (map[string]fileState, error) {
+	files := map[string]fileState{}
+	err := filepath.WalkDir(dir, func(p string, e fs.DirEntry, err error) error {
+		if err != nil || !e.Type().IsRegular() {
+			return err
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel = filepath.ToSlash(rel); rel != leaseFile {
+			files[rel] = fileState{Size: info.Size(), ModTime: info.ModTime()}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// changedFiles returns the files added, removed or modified from before to
+// after, sorted.
+func changedFiles(before, after map[string]fileState) []string {
+	var files []string
+	for p := range before {
+		if changed(before, after, p) {
+			files = append(files, p)
+		}
+	}
+	for p := range after {
+		if _, ok := before[p]; !ok {
+			files = append(files, p)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// modTimeNotSupported is the precision rclone reports for remotes without
+// modification times.
+const modTimeNotSupported = 100 * 365 * 24 * time.Hour
+
+// modTimePrecision returns the precision of modification times of the
+// remote of pub.
+func (d *driver) modTimePrecision(ctx context.Context, pub *publication) (time.Duration, error) {
+	res, err := d.rcTarget(ctx, pub.TargetPath, "operations/fsinfo", map[string]any{
+		"fs": fmt.Sprintf("%s:%s", pub.Remote, pub.RemotePath),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(res.Get("Precision").Int()), nil
+}
+
+// sameFile tells whether p is the same in the local copy and on the remote,
+// or missing from both, comparing modification times with the precision
+// of the remote.
+func sameFile(local, remote map[string]fileState, p string, precision time.Duration) bool {
+	l, inLocal := local[p]
+	r, inRemote := remote[p]
+	if inLocal != inRemote || l.Size != r.Size {
+		return false
+	}
+	if !inLocal || precision >= modTimeNotSupported {
+		return true
+	}
+	diff := l.ModTime.Sub(r.ModTime)
+	return diff <= precision && diff >= -precision
+}
+
+func changed(before, after map[string]fileState, p string) bool {
+	b, inBefore := before[p]
+	a, inAfter := after[p]
+	return inBefore != inAfter || a.Size != b.Size || !a.ModTime.Equal(b.ModTime)
+}
+
+// chownTree applies the ownership options of vfsOpt to the files below dir.
+func chownTree(dir string, vfsOpt map[string]any) error {
+	uid, hasUID := optInt(vfsOpt["UID"])
+	gid, hasGID := optInt(vfsOpt["GID"])
+	if !hasUID && !hasGID {
+		return nil
+	}
+	if !hasUID {
+		uid = -1
+	}
+	if !hasGID {
+		gid = -1
+	}
+	return filepath.WalkDir(dir, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, uid, gid)
+	})
+}
+
+// optInt converts numeric options, as parsed from JSON or set by the
+// driver, to int.
+func optInt(v any) (int, bool) {
+	switch n := v.(type) {
+	case uint64:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case float64:
+		return int(n), true
+	case int:
+		return n, true
+	}
+	return 0, false
+}
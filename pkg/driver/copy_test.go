@@ -0,0 +1,168 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func TestChanged(t *testing.T) {
+	before := map[string]fileState{"a": {Size: 1, ModTime: t0}}
+	tests := []struct {
+		name  string
+		after map[string]fileState
+		want  bool
+	}{
+		{"same", map[string]fileState{"a": {Size: 1, ModTime: t0.In(time.Local)}}, false},
+		{"size", map[string]fileState{"a": {Size: 2, ModTime: t0}}, true},
+		{"mod time", map[string]fileState{"a": {Size: 1, ModTime: t0.Add(time.Nanosecond)}}, true},
+		{"removed", map[string]fileState{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := changed(before, tt.after, "a"); got != tt.want {
+				t.Errorf("changed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if changed(before, map[string]fileState{"a": {Size: 1, ModTime: t0}}, "b") {
+		t.Error("a file missing from both is changed")
+	}
+	if !changed(nil, before, "a") {
+		t.Error("an added file is not changed")
+	}
+}
+
+func TestChangedFiles(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after map[string]fileState
+		want          []string
+	}{
+		{"none", nil, nil, nil},
+		{"unchanged", map[string]fileState{"a": {1, t0}}, map[string]fileState{"a": {1, t0}}, nil},
+		{
+			"added, removed and modified, sorted",
+			map[string]fileState{"c": {1, t0}, "b": {1, t0}, "keep": {1, t0}},
+			map[string]fileState{"a": {1, t0}, "b": {2, t0}, "keep": {1, t0}},
+			[]string{"a", "b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := changedFiles(tt.before, tt.after); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changedFiles = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		local     map[string]fileState
+		remote    map[string]fileState
+		precision time.Duration
+		want      bool
+	}{
+		{"missing from both", nil, nil, time.Second, true},
+		{"only local", map[string]fileState{"a": {1, t0}}, nil, time.Second, false},
+		{"only remote", nil, map[string]fileState{"a": {1, t0}}, time.Second, false},
+		{"size", map[string]fileState{"a": {1, t0}}, map[string]fileState{"a": {2, t0}}, time.Second, false},
+		{"within precision", map[string]fileState{"a": {1, t0}}, map[string]fileState{"a": {1, t0.Add(-time.Second)}}, time.Second, true},
+		{"beyond precision", map[string]fileState{"a": {1, t0}}, map[string]fileState{"a": {1, t0.Add(2 * time.Second)}}, time.Second, false},
+		{"no mod times", map[string]fileState{"a": {1, t0}}, map[string]fileState{"a": {1, t0.Add(time.Hour)}}, modTimeNotSupported, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameFile(tt.local, tt.remote, "a", tt.precision); got != tt.want {
+				t.Errorf("sameFile = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlanCopyOut(t *testing.T) {
+	old, edit := fileState{1, t0}, fileState{2, t0.Add(time.Minute)}
+	other := fileState{3, t0.Add(time.Hour)}
+	snap := &copySnapshot{
+		Local:  map[string]fileState{"edited": old, "deleted": old, "conflict": old, "synced": old, "untouched": old},
+		Remote: map[string]fileState{"edited": old, "deleted": old, "conflict": old, "synced": old, "untouched": old},
+	}
+	local := map[string]fileState{"edited": edit, "conflict": edit, "synced": edit, "untouched": old, "added": edit}
+	remote := map[string]fileState{"edited": old, "deleted": old, "conflict": other, "synced": edit, "untouched": other}
+
+	tests := []struct {
+		name string
+		opts copyOptions
+		want copyOutPlan
+	}{
+		{
+			"fail", copyOptions{SyncBack: syncBackCopy, Conflict: conflictFail},
+			copyOutPlan{uploads: []string{"added", "edited"}, conflicts: []string{"conflict"}, synced: []string{"synced"}},
+		},
+		{
+			"local wins", copyOptions{SyncBack: syncBackCopy, Conflict: conflictLocal},
+			copyOutPlan{uploads: []string{"added", "conflict", "edited"}, conflicts: []string{"conflict"}, synced: []string{"synced"}},
+		},
+		{
+			"remote wins", copyOptions{SyncBack: syncBackCopy, Conflict: conflictRemote},
+			copyOutPlan{uploads: []string{"added", "edited"}, downloads: []string{"conflict"}, conflicts: []string{"conflict"}, synced: []string{"synced"}},
+		},
+		{
+			"sync deletes", copyOptions{SyncBack: syncBackSync, Conflict: conflictFail},
+			copyOutPlan{uploads: []string{"added", "edited"}, deletes: []string{"deleted"}, conflicts: []string{"conflict"}, synced: []string{"synced"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := planCopyOut(snap, local, remote, time.Second, &tt.opts); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("planCopyOut = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdvanceFiles(t *testing.T) {
+	old, changed := fileState{1, t0}, fileState{2, t0.Add(time.Minute)}
+	before := map[string]fileState{"uploaded": old, "deleted": old, "remote only": old}
+	after := map[string]fileState{"uploaded": changed, "remote only": changed, "added": changed}
+	got := advanceFiles(before, after, []string{"uploaded", "deleted", "added"})
+	// the change of the remote alone stays a change, for later conflicts
+	want := map[string]fileState{"uploaded": changed, "remote only": old, "added": changed}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("advanceFiles = %v, want %v", got, want)
+	}
+	if before["uploaded"] != old {
+		t.Error("the files before are changed")
+	}
+	if got := advanceFiles(nil, after, []string{"added"}); !reflect.DeepEqual(got, map[string]fileState{"added": changed}) {
+		t.Errorf("advanceFiles of no files = %v", got)
+	}
+}
@@ -25,35 +25,106 @@ SOFTWARE.
 package driver
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
-	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"regexp"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/tidwall/gjson"
+	"golang.org/x/net/context"
 )
 
+// Mode selects which CSI services the driver serves.
+type Mode string
+
+const (
+	ModeController Mode = "controller"
+	ModeNode       Mode = "node"
+	ModeAll        Mode = "all"
+)
+
+// defaults of the default instance, other instances get their name appended
+const (
+	defaultPluginName = "csi-rclone"
+	defaultStateDir   = "/var/lib/csi-rclone"
+	defaultCacheDir   = "/var/cache/csi-rclone"
+)
+
+var instanceName = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+
 type Config struct {
+	Mode          Mode
 	NodeID        string
 	Endpoint      string
 	PluginName    string
 	PluginVersion string
+	Commit        string
 	RcloneConfig  string
+	// Instance distinguishes drivers running side by side on a node, the
+	// plugin name, state, cache and rc address are derived from it.
+	Instance string
+	StateDir string
+	CacheDir string
+	RcAddr   string
+	// CacheMaxSize limits the VFS caches of all volumes of the node, then
+	// volumes get CacheVolumeSize unless they set their own size.
+	CacheMaxSize      int64
+	CacheVolumeSize   int64
+	CacheMinFreeSpace int64
+	// MetricsAddr is the http address serving expvar metrics, if any.
+	MetricsAddr string
+	// AdminAddr is the address of the admin api of the node, if any.
+	AdminAddr string
+	// Attach enables attachments: the controller records them and nodes
+	// only publish volumes attached to them. Attachments are kept in the
+	// state directory of the controller, so there must be only one.
+	Attach bool
+	// DefaultMounter mounts volumes which do not select a mounter.
+	DefaultMounter string
+	// HealthInterval is the period of the health checks of mounts, which
+	// are disabled if 0, and HealthTimeout the time mounts have to answer.
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+	// InlineBackends are the backend types inline volumes may use, nil
+	// for DefaultInlineBackends and empty to refuse inline volumes.
+	InlineBackends []string
 }
 
 type driver struct {
-	config Config
-	rcd    *exec.Cmd
+	config       Config
+	backend      rcBackend
+	rclone       *rcloneInfo
+	publications *publications
+	attachments  *attachments
+	renewers     tasks
+	prewarms     tasks
+	pauses       tasks
+	syncs        tasks
+	checks       tasks
+	conditions   conditions
+	// volumeBackends are the rcd of volumes with their own limits
+	volumeBackends volumeBackends
+	// mounters mount volumes, by the name selected in their context
+	mounters map[string]mounter
 }
 
 func NewDriver(cfg Config) (*driver, error) {
-	if cfg.NodeID == "" {
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = ModeAll
+	case ModeController, ModeNode, ModeAll:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", cfg.Mode)
+	}
+
+	if cfg.Mode != ModeController && cfg.NodeID == "" {
 		return nil, errors.New("no node id provided")
 	}
 
@@ -61,78 +132,214 @@ func NewDriver(cfg Config) (*driver, error) {
 		return nil, errors.New("no driver endpoint provided")
 	}
 
-	cfg.PluginName = "csi-rclone"
-	cfg.PluginVersion = "v0.1"
+	if cfg.Attach && cfg.Mode == ModeAll {
+		// every node would run a controller with its own attachments
+		return nil, errors.New("attachments need a single controller, run it separately with -mode=controller")
+	}
+
+	switch cfg.DefaultMounter {
+	case "":
+		cfg.DefaultMounter = mounterFUSE
+	case mounterFUSE, mounterNFS, mounterWebDAV, mounterCopy, mounterBisync, mounterBind:
+	default:
+		return nil, fmt.Errorf("unknown mounter %q", cfg.DefaultMounter)
+	}
+
+	if cfg.HealthTimeout <= 0 {
+		cfg.HealthTimeout = defaultHealthTimeout
+	}
+
+	if cfg.InlineBackends == nil {
+		cfg.InlineBackends = DefaultInlineBackends
+	}
+
+	if cfg.Instance != "" && !instanceName.MatchString(cfg.Instance) {
+		return nil, fmt.Errorf("invalid instance name %q", cfg.Instance)
+	}
+	if cfg.PluginName == "" {
+		cfg.PluginName = instanced(defaultPluginName, cfg.Instance)
+	}
+	if cfg.PluginVersion == "" {
+		cfg.PluginVersion = "v0.1"
+	}
+	if cfg.StateDir == "" {
+		cfg.StateDir = instanced(defaultStateDir, cfg.Instance)
+	}
+	if cfg.CacheDir == "" {
+		cfg.CacheDir = instanced(defaultCacheDir, cfg.Instance)
+	}
+	// the default instance keeps the default config of rclone, which
+	// existing deployments have their remotes in
+	if cfg.RcloneConfig == "" && cfg.Instance != "" {
+		cfg.RcloneConfig = filepath.Join(cfg.StateDir, "rclone.conf")
+	}
+	if cfg.RcAddr == "" {
+		cfg.RcAddr = "unix://" + filepath.Join(cfg.StateDir, "rc.sock")
+	}
+	for _, dir := range []string{cfg.StateDir, cfg.CacheDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
 
 	d := &driver{
-		config: cfg,
+		config:   cfg,
+		renewers: newTasks(),
+		prewarms: newTasks(),
+		pauses:   newTasks(),
+		syncs:    newTasks(),
+		checks:   newTasks(),
+		conditions: conditions{
+			byTarget: make(map[string]*csi.VolumeCondition),
+		},
+		volumeBackends: volumeBackends{
+			byTarget: make(map[string]rcBackend),
+		},
+	}
+	d.mounters = newMounters(d)
+	if d.isNode() {
+		pubs, err := loadPublications(filepath.Join(cfg.StateDir, "publications.json"))
+		if err != nil {
+			return nil, err
+		}
+		d.publications = pubs
+	}
+	if d.isController() && cfg.Attach {
+		atts, err := loadAttachments(filepath.Join(cfg.StateDir, "attachments.json"))
+		if err != nil {
+			return nil, err
+		}
+		d.attachments = atts
+	}
+	if err := d.startBackend(); err != nil {
+		return nil, err
 	}
-	return d, d.startRCD()
+	if err := d.checkRclone(context.Background()); err != nil {
+		return nil, errors.Join(err, d.backend.Stop())
+	}
+	if d.isNode() {
+		d.restoreVolumeBackends()
+		d.restoreLeases()
+		d.restoreSyncs()
+		d.restoreChecks()
+	}
+	return d, nil
 }
 
 func (d *driver) Run() error {
+	// d itself implements ControllerServer, NodeServer, and IdentityServer,
+	// only the ones of the configured mode are registered.
+	var cs csi.ControllerServer
+	var ns csi.NodeServer
+	if d.isController() {
+		cs = d
+	}
+	if d.isNode() {
+		ns = d
+	}
+	if d.config.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		go func() {
+			err := http.ListenAndServe(d.config.MetricsAddr, mux)
+			slog.Error("metrics server stopped", "addr", d.config.MetricsAddr, "err", err)
+		}()
+	}
+	if d.config.AdminAddr != "" && d.isNode() {
+		go func() {
+			err := d.serveAdmin(d.config.AdminAddr)
+			slog.Error("admin server stopped", "addr", d.config.AdminAddr, "err", err)
+		}()
+	}
 	s := NewNonBlockingGRPCServer()
-	// hp itself implements ControllerServer, NodeServer, and IdentityServer.
-	s.Start(d.config.Endpoint, d, d, d)
+	s.Start(d.config.Endpoint, d, cs, ns)
 	s.Wait()
 
+	return errors.Join(d.volumeBackends.stopAll(), d.backend.Stop())
+}
+
+func instanced(s, instance string) string {
+	if instance == "" {
+		return s
+	}
+	return s + "-" + instance
+}
+
+func (d *driver) isController() bool {
+	return d.config.Mode == ModeController || d.config.Mode == ModeAll
+}
+
+func (d *driver) isNode() bool {
+	return d.config.Mode == ModeNode || d.config.Mode == ModeAll
+}
+
+// startBackend starts the rclone backing the driver, linked in process when
+// built with the librclone tag, or a rcd child process otherwise. The
+// controller only needs remote operations, so in controller mode mount
+// methods are refused and no FUSE prerequisites are required.
+func (d *driver) startBackend() error {
+	var b rcBackend
 	var err error
-	ch := make(chan struct{})
-	go func() {
-		err = d.coreQuit()
-		ch <- struct{}{}
-	}()
-	select {
-	case <-ch:
-	case <-time.After(5 * time.Second):
-		glog.Infof("killing rcd %+v", d.rcd.Process.Kill())
-	}
-	glog.Infof("waiting tcd %+v", d.rcd.Wait())
-	return err
-}
-
-func (d *driver) startRCD() error {
-	args := []string{}
+	if embeddedRclone {
+		b, err = newEmbeddedBackend(d.config)
+	} else {
+		b, err = newRcdBackend(slog.Default(), d.config.RcAddr, d.rcdArgs())
+	}
+	if err != nil {
+		return err
+	}
+	d.backend = b
+	if !d.isNode() {
+		d.backend = remoteOnlyBackend{b}
+	}
+	return nil
+}
+
+// rcdArgs are the arguments shared by all rcd of the driver.
+func (d *driver) rcdArgs() []string {
+	args := []string{"--cache-dir", d.config.CacheDir}
 	if d.config.RcloneConfig != "" {
 		args = append(args, "--config", d.config.RcloneConfig)
 	}
-	d.rcd = exec.Command("rclone", "rcd", "--rc-no-auth", "--log-level=INFO")
-	d.rcd.Stdout = os.Stdout
-	d.rcd.Stderr = os.Stderr
-	return d.rcd.Start()
+	return args
+}
+
+func (d *driver) rc(ctx context.Context, method string, data map[string]any) (gjson.Result, error) {
+	return d.rcOn(ctx, d.backend, method, data)
+}
+
+// rcTarget calls method on the backend serving the mount of target.
+func (d *driver) rcTarget(ctx context.Context, target, method string, data map[string]any) (gjson.Result, error) {
+	return d.rcOn(ctx, d.volumeBackends.get(target, d.backend), method, data)
 }
 
-func (d *driver) rc(method string, data map[string]any) (gjson.Result, error) {
+func (d *driver) rcOn(ctx context.Context, backend rcBackend, method string, data map[string]any) (gjson.Result, error) {
 	var res gjson.Result
 
 	b, err := json.Marshal(data)
 	if err != nil {
 		return res, err
 	}
-	resp, err := http.DefaultClient.Post(fmt.Sprintf("http://localhost:5572/%s", method), "application/json", bytes.NewReader(b))
-	if err != nil {
-		return res, err
-	}
-	defer resp.Body.Close()
-
-	all, err := ioutil.ReadAll(resp.Body)
+	logFrom(ctx).Debug("rc call", "rc_method", method, "input", string(b))
+	all, code, err := backend.Call(ctx, method, b)
 	if err != nil {
 		return res, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("%d: %s", resp.StatusCode, all)
+	// rc echoes the input on errors, which may contain credentials
+	if code != http.StatusOK {
+		err = fmt.Errorf("%d: %s", code, secrets.String(string(all)))
 	} else {
 		res = gjson.ParseBytes(all)
 		if res.Get("error").String() != "" {
-			err = fmt.Errorf("%d: %s", resp.StatusCode, all)
+			err = fmt.Errorf("%d: %s", code, secrets.String(string(all)))
 		}
 	}
 	return res, err
 }
 
-func (d *driver) remoteList() ([]string, error) {
-	res, err := d.rc("config/listremotes", nil)
+func (d *driver) remoteList(ctx context.Context) ([]string, error) {
+	res, err := d.rc(ctx, "config/listremotes", nil)
 	v := []string{}
 	for _, e := range res.Get("remotes").Array() {
 		v = append(v, e.String())
@@ -140,12 +347,13 @@ func (d *driver) remoteList() ([]string, error) {
 	return v, err
 }
 
-func (d *driver) remoteAbout(remote, path string) (gjson.Result, error) {
-	return d.rc("operations/about", map[string]any{"fs": fmt.Sprintf("%s:%s", remote, path)})
+func (d *driver) remoteAbout(ctx context.Context, remote, path string) (gjson.Result, error) {
+	return d.rc(ctx, "operations/about", map[string]any{"fs": fmt.Sprintf("%s:%s", remote, path)})
 }
 
-func (d *driver) remoteCreate(remote string, parameters string) (gjson.Result, error) {
-	return d.rc("config/create", map[string]any{
+func (d *driver) remoteCreate(ctx context.Context, remote string, parameters string) (gjson.Result, error) {
+	secrets.AddParameters(parameters)
+	return d.rc(ctx, "config/create", map[string]any{
 		"name":       remote,
 		"type":       gjson.Parse(parameters).Get("type").String(),
 		"parameters": parameters,
@@ -153,51 +361,6 @@ func (d *driver) remoteCreate(remote string, parameters string) (gjson.Result, e
 	})
 }
 
-func (d *driver) remoteMount(remote, rpath, target string, vfs, mount map[string]any) (res gjson.Result, err error) {
-	if _, e := os.Stat(target); e != nil && errors.Is(e, os.ErrNotExist) {
-		if err = os.MkdirAll(target, 0755); err != nil {
-			return
-		}
-	}
-	if _, err = os.Stat(target); err != nil {
-		return
-	}
-	res, err = d.remoteUmount(target)
-	if err != nil {
-		return res, err
-	}
-	vb, err := json.Marshal(vfs)
-	if err != nil {
-		return gjson.Result{}, err
-	}
-	mb, err := json.Marshal(mount)
-	if err != nil {
-		return gjson.Result{}, err
-	}
-	return d.rc("mount/mount", map[string]any{
-		"fs":         fmt.Sprintf("%s:%s", remote, rpath),
-		"mountPoint": target,
-		"mountOpt":   string(mb),
-		"vfsOpt":     string(vb),
-	})
-}
-
-func (d *driver) remoteUmount(target string) (res gjson.Result, err error) {
-	if target == "" {
-		res, err = d.rc("mount/unmountall", map[string]any{})
-	} else {
-		if _, e := os.Stat(target); e != nil {
-			return
-		}
-		if e := exec.Command("mountpoint", target).Run(); e != nil {
-			return
-		}
-		res, err = d.rc("mount/unmount", map[string]any{"mountPoint": target})
-	}
-	return
-}
-
-func (d *driver) coreQuit() error {
-	_, err := d.rc("core/quit", nil)
-	return err
+func (d *driver) coreVersion(ctx context.Context) (gjson.Result, error) {
+	return d.rc(ctx, "core/version", nil)
 }
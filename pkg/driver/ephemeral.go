@@ -0,0 +1,94 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/tidwall/gjson"
+	"golang.org/x/net/context"
+)
+
+// ephemeralKey is set by kubelet for CSI ephemeral inline volumes.
+const ephemeralKey = "csi.storage.k8s.io/ephemeral"
+
+// DefaultInlineBackends are the backend types of inline volumes unless
+// configured otherwise: storage services only. Pod authors are not trusted
+// with the disks of the node (local), nor with the remotes of the driver,
+// which wrapping backends like alias, union, combine or crypt refer to.
+var DefaultInlineBackends = []string{
+	"azureblob", "azurefiles", "b2", "box", "drive", "dropbox", "fichier",
+	"filefabric", "ftp", "gcs", "gphotos", "hdfs", "hidrive", "http",
+	"internetarchive", "jottacloud", "koofr", "linkbox", "mailru", "mega",
+	"netstorage", "onedrive", "opendrive", "oracleobjectstorage", "pcloud",
+	"pikpak", "premiumizeme", "protondrive", "putio", "qingstor", "quatrix",
+	"s3", "seafile", "sftp", "sharefile", "sia", "smb", "storj", "sugarsync",
+	"swift", "uptobox", "webdav", "yandex", "zoho",
+}
+
+var invalidRemoteChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
+
+// ephemeralRemote names the remote of an inline volume. Kubelet generates
+// a volume id per pod and volume, so the remote is unique to the pod.
+func ephemeralRemote(volumeID string) string {
+	return "ephemeral-" + invalidRemoteChars.ReplaceAllString(volumeID, "_")
+}
+
+// mergeSecrets adds the publish secrets of an inline volume to its remote
+// parameters, as inline volumes have no other place to keep credentials.
+func mergeSecrets(parameters string, secrets map[string]string) (string, error) {
+	params := map[string]any{}
+	if parameters != "" {
+		if err := json.Unmarshal([]byte(parameters), &params); err != nil {
+			return "", err
+		}
+	}
+	for k, v := range secrets {
+		params[k] = v
+	}
+	b, err := json.Marshal(params)
+	return string(b), err
+}
+
+// checkInlineBackend refuses the parameters of an inline volume unless
+// their backend type is one of allowed.
+func checkInlineBackend(parameters string, allowed []string) error {
+	typ := gjson.Parse(parameters).Get("type").String()
+	if !slices.Contains(allowed, typ) {
+		return fmt.Errorf("backend type %q is not allowed for inline volumes", typ)
+	}
+	return nil
+}
+
+// removeEphemeral deletes the remote of an inline volume and its VFS cache.
+func (d *driver) removeEphemeral(ctx context.Context, pub *publication) error {
+	if _, err := d.rc(ctx, "config/delete", map[string]any{"name": pub.Remote}); err != nil {
+		return err
+	}
+	return d.removeCache(pub.Remote)
+}
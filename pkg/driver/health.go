@@ -0,0 +1,267 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"maps"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+// remountKey in the volume context remounts the volume when its mount is
+// found unhealthy.
+const remountKey = "remount"
+
+const (
+	defaultHealthTimeout = 10 * time.Second
+	remountMaxBackoff    = 10 * time.Minute
+)
+
+// healthVars exposes the health of publications, by target path.
+var healthVars = expvar.NewMap("health")
+
+// conditions are the volume conditions of publications, by target path,
+// as last seen by the health checks.
+type conditions struct {
+	mu       sync.Mutex
+	byTarget map[string]*csi.VolumeCondition
+}
+
+func (c *conditions) get(target string) *csi.VolumeCondition {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cond, ok := c.byTarget[target]; ok {
+		return cond
+	}
+	return &csi.VolumeCondition{Message: "ok"}
+}
+
+func (c *conditions) set(target string, cond *csi.VolumeCondition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.byTarget[target] = cond
+}
+
+func (c *conditions) remove(target string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.byTarget, target)
+}
+
+// startChecking checks the health of the mount of pub in the background,
+// until stopChecking is called.
+func (d *driver) startChecking(pub *publication) {
+	if d.config.HealthInterval <= 0 {
+		return
+	}
+	d.checks.start(pub.TargetPath, func(ctx context.Context) {
+		d.checkHealth(ctx, pub)
+	})
+}
+
+func (d *driver) stopChecking(target string) {
+	d.checks.stop(target)
+	d.conditions.remove(target)
+	healthVars.Delete(target)
+}
+
+// restoreChecks resumes the health checks of publications made before a
+// restart of the driver.
+func (d *driver) restoreChecks() {
+	for _, pub := range d.publications.list() {
+		d.startChecking(pub)
+	}
+}
+
+// checkHealth probes the mount of pub on every health interval. A mount
+// which is gone, stale or does not answer in time makes the volume
+// condition abnormal, and is remounted if the volume asks for it, with an
+// exponential backoff between failed attempts.
+func (d *driver) checkHealth(ctx context.Context, pub *publication) {
+	l := slog.Default().With("volume_id", pub.VolumeID, "target_path", pub.TargetPath)
+	stats := new(expvar.Map).Init()
+	state := new(expvar.String)
+	state.Set("ok")
+	remounts := new(expvar.Int)
+	stats.Set("volume_id", expvarString(pub.VolumeID))
+	stats.Set("state", state)
+	stats.Set("remounts", remounts)
+	healthVars.Set(pub.TargetPath, stats)
+
+	t := time.NewTicker(d.config.HealthInterval)
+	defer t.Stop()
+	var pending chan error
+	var since, next time.Time
+	backoff := d.config.HealthInterval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		// a hung probe is waited for, instead of piling up more of them
+		if pending == nil {
+			pending = d.probeMount(pub)
+		}
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case err = <-pending:
+			pending = nil
+		case <-time.After(d.config.HealthTimeout):
+			err = fmt.Errorf("mount did not answer within %s", d.config.HealthTimeout)
+		}
+
+		if err == nil {
+			if !since.IsZero() {
+				l.Info("volume recovered", "downtime", time.Since(since))
+			}
+			since, next = time.Time{}, time.Time{}
+			backoff = d.config.HealthInterval
+			d.conditions.set(pub.TargetPath, &csi.VolumeCondition{Message: "ok"})
+			state.Set("ok")
+			continue
+		}
+		if since.IsZero() {
+			since = time.Now()
+			l.Error("volume unhealthy", "err", err)
+		}
+		d.conditions.set(pub.TargetPath, &csi.VolumeCondition{Abnormal: true, Message: err.Error()})
+		state.Set(err.Error())
+		if !pub.Remount || time.Now().Before(next) {
+			continue
+		}
+
+		l.Warn("remounting unhealthy volume", "err", err, "unhealthy_for", time.Since(since))
+		remounts.Add(1)
+		if err := d.remount(ctx, pub); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			next = time.Now().Add(backoff)
+			l.Error("failed to remount volume", "err", err, "retry_in", backoff)
+			backoff = min(backoff*2, remountMaxBackoff)
+			continue
+		}
+		// the previous probe may hang on the old mount forever
+		pending = nil
+		l.Info("volume remounted, checking it on the next interval")
+	}
+}
+
+// probeMount tells, through the returned channel, whether the target of pub
+// is mounted and answers. Probing a hung mount never returns.
+func (d *driver) probeMount(pub *publication) chan error {
+	ch := make(chan error, 1)
+	go func() {
+		ok, err := d.mounterOf(pub).IsMounted(pub)
+		if err == nil && !ok {
+			err = errors.New("not mounted")
+		}
+		ch <- err
+	}()
+	return ch
+}
+
+// remount replaces the mount of pub with a new one, with the options pub
+// was published with. The old mount may hang, so it is lazily unmounted,
+// the workload keeps the files it opened and sees the new mount for
+// anything else.
+func (d *driver) remount(ctx context.Context, pub *publication) error {
+	var expiry time.Time
+	if pub.LeaseTTL > 0 && !pub.Readonly {
+		// the lease may have been lost meanwhile
+		var err error
+		if expiry, err = d.acquireLease(ctx, pub); err != nil {
+			return err
+		}
+	}
+	// rclone keeps the VFS of a mount until the mount is unmounted through
+	// it, which would leave two VFSes of the volume for vfs methods. Mounts
+	// which still answer are unmounted through rclone, hung ones can only
+	// be unmounted lazily and leave their VFS behind.
+	if m, ok := d.mounterOf(pub).(fuseMounter); ok {
+		if ok, err := mounted(pub.TargetPath, d.config.HealthTimeout); ok && !errors.Is(err, errStaleMount) {
+			uctx, cancel := context.WithTimeout(ctx, d.config.HealthTimeout)
+			if err := m.Unmount(uctx, pub); err != nil {
+				logFrom(ctx).Warn("failed to unmount unhealthy volume through rclone", "target_path", pub.TargetPath, "err", err)
+			}
+			cancel()
+		}
+	}
+	// EINVAL if it is not mounted anymore
+	if err := unmountStale(pub.TargetPath); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := d.mounterOf(pub).Mount(ctx, pub, maps.Clone(pub.VfsOpt), maps.Clone(pub.MountOpt)); err != nil {
+		return err
+	}
+	// the renewer exits when the lease is lost, restart it unless the
+	// volume is being unpublished, which cancels ctx
+	if !expiry.IsZero() && ctx.Err() == nil {
+		d.startRenewing(pub, expiry)
+	}
+	return nil
+}
+
+// volumeStats returns the usage of the mount of pub, or its condition if
+// it is unhealthy or does not answer in time.
+func (d *driver) volumeStats(ctx context.Context, pub *publication) *csi.NodeGetVolumeStatsResponse {
+	cond := d.conditions.get(pub.TargetPath)
+	if cond.Abnormal {
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: cond}
+	}
+	type result struct {
+		usage []*csi.VolumeUsage
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		usage, err := d.mounterOf(pub).Stats(ctx, pub)
+		ch <- result{usage, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return &csi.NodeGetVolumeStatsResponse{VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: r.err.Error()}}
+		}
+		return &csi.NodeGetVolumeStatsResponse{Usage: r.usage, VolumeCondition: cond}
+	case <-time.After(d.config.HealthTimeout):
+		msg := fmt.Sprintf("mount did not answer within %s", d.config.HealthTimeout)
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: msg}}
+	}
+}
@@ -25,34 +25,94 @@ SOFTWARE.
 package driver
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+const probeTimeout = 3 * time.Second
+
 func (d *driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
-	glog.V(5).Infof("Using default GetPluginInfo")
+	logFrom(ctx).Debug("using default GetPluginInfo")
 
 	return &csi.GetPluginInfoResponse{
 		Name:          d.config.PluginName,
 		VendorVersion: d.config.PluginVersion,
+		Manifest: map[string]string{
+			"commit":            d.config.Commit,
+			"go-version":        runtime.Version(),
+			"rclone-version":    d.rclone.Version,
+			"rclone-go-version": d.rclone.GoVersion,
+		},
 	}, nil
 }
 
 func (d *driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{}, nil
+	if err := d.ready(ctx); err != nil {
+		logFrom(ctx).Warn("not ready", "err", err)
+		return nil, status.Errorf(codes.FailedPrecondition, "not ready: %s", err)
+	}
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
+}
+
+// ready checks that rcd is up and answering, and that the default mounter
+// can mount. Volumes selecting another mounter check it on publishing.
+func (d *driver) ready(ctx context.Context) error {
+	if err := d.backend.Ready(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	if _, err := d.coreVersion(ctx); err != nil {
+		return fmt.Errorf("rcd is not responding: %w", err)
+	}
+	if !d.isNode() {
+		return nil
+	}
+	if err := d.mounters[d.config.DefaultMounter].Ready(); err != nil {
+		return fmt.Errorf("%s mounter: %w", d.config.DefaultMounter, err)
+	}
+	return nil
+}
+
+// checkFuse verifies the prerequisites of rclone mount.
+func checkFuse() error {
+	fi, err := os.Stat("/dev/fuse")
+	if err != nil {
+		return fmt.Errorf("fuse device: %w", err)
+	}
+	if fi.Mode()&os.ModeCharDevice == 0 {
+		return errors.New("fuse device: /dev/fuse is not a character device")
+	}
+	if _, err := exec.LookPath("fusermount3"); err == nil {
+		return nil
+	}
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		return errors.New("neither fusermount3 nor fusermount found in PATH")
+	}
+	return nil
 }
 
 func (d *driver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	glog.V(5).Infof("Using default capabilities")
-	caps := []*csi.PluginCapability{
-		{
+	logFrom(ctx).Debug("using default capabilities")
+	caps := []*csi.PluginCapability{}
+	if d.isController() {
+		caps = append(caps, &csi.PluginCapability{
 			Type: &csi.PluginCapability_Service_{
 				Service: &csi.PluginCapability_Service{
 					Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
 				},
 			},
-		},
+		})
 	}
 	return &csi.GetPluginCapabilitiesResponse{Capabilities: caps}, nil
 }
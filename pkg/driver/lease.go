@@ -0,0 +1,213 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Volume context keys of writer leases.
+const (
+	leaseKey    = "lease"
+	leaseTTLKey = "leaseTTL"
+)
+
+const (
+	// leaseFile is the lease object, at the root of the mounted remote path.
+	leaseFile       = ".csi-rclone.lock"
+	defaultLeaseTTL = 30 * time.Second
+	minLeaseTTL     = 3 * time.Second
+)
+
+// lease is held by the node writing to a volume, until it expires.
+type lease struct {
+	Node   string    `json:"node"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// parseLease returns the lease ttl of a volume, zero if leases are disabled.
+func parseLease(volumeContext map[string]string) (time.Duration, error) {
+	if v, ok := volumeContext[leaseKey]; !ok {
+		return 0, nil
+	} else if enabled, err := strconv.ParseBool(v); err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", leaseKey, v, err)
+	} else if !enabled {
+		return 0, nil
+	}
+	v, ok := volumeContext[leaseTTLKey]
+	if !ok {
+		return defaultLeaseTTL, nil
+	}
+	ttl, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", leaseTTLKey, v, err)
+	}
+	if ttl < minLeaseTTL {
+		return 0, fmt.Errorf("%s must be at least %s", leaseTTLKey, minLeaseTTL)
+	}
+	return ttl, nil
+}
+
+// readLease fetches the lease of the remote path of pub, nil if there is
+// none.
+func (d *driver) readLease(ctx context.Context, pub *publication) (*lease, error) {
+	l := &lease{}
+	ok, err := d.readRemoteJSON(ctx, fmt.Sprintf("%s:%s", pub.Remote, pub.RemotePath), leaseFile, l)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (d *driver) writeLease(ctx context.Context, pub *publication, l *lease) error {
+	return d.writeRemoteJSON(ctx, fmt.Sprintf("%s:%s", pub.Remote, pub.RemotePath), leaseFile, l)
+}
+
+// acquireLease takes or renews the lease of pub, and returns its expiry. It
+// fails while another node holds an unexpired lease.
+func (d *driver) acquireLease(ctx context.Context, pub *publication) (time.Time, error) {
+	cur, err := d.readLease(ctx, pub)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if cur != nil && cur.Node != d.config.NodeID && time.Now().Before(cur.Expiry) {
+		return time.Time{}, status.Errorf(codes.Unavailable, "volume %s is leased to node %s until %s", pub.VolumeID, cur.Node, cur.Expiry.Format(time.RFC3339))
+	}
+	l := &lease{Node: d.config.NodeID, Expiry: time.Now().Add(pub.LeaseTTL)}
+	if err := d.writeLease(ctx, pub, l); err != nil {
+		return time.Time{}, err
+	}
+	// remotes have no compare and swap, read back to catch a racing writer
+	cur, err = d.readLease(ctx, pub)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if cur == nil || cur.Node != d.config.NodeID {
+		return time.Time{}, status.Errorf(codes.Unavailable, "volume %s: lost the lease to another node", pub.VolumeID)
+	}
+	return l.Expiry, nil
+}
+
+// holdLease checks that the node still holds the lease of pub, if leased
+// and writable, before local changes are written to the remote: another
+// node may be writing once the lease is lost. With retake, a lease which
+// expired without being taken over is taken again.
+func (d *driver) holdLease(ctx context.Context, pub *publication, retake bool) error {
+	if pub.LeaseTTL == 0 || pub.Readonly {
+		return nil
+	}
+	cur, err := d.readLease(ctx, pub)
+	if err != nil {
+		return err
+	}
+	if cur != nil && cur.Node == d.config.NodeID && time.Now().Before(cur.Expiry) {
+		return nil
+	}
+	if retake {
+		if _, err := d.acquireLease(ctx, pub); err == nil {
+			return nil
+		}
+	}
+	return status.Errorf(codes.FailedPrecondition, "volume %s: the node lost its lease, refusing to write local changes to the remote", pub.VolumeID)
+}
+
+// releaseLease deletes the lease of pub, if held by this node.
+func (d *driver) releaseLease(ctx context.Context, pub *publication) error {
+	cur, err := d.readLease(ctx, pub)
+	if err != nil || cur == nil || cur.Node != d.config.NodeID {
+		return err
+	}
+	_, err = d.rc(ctx, "operations/deletefile", map[string]any{
+		"fs":     fmt.Sprintf("%s:%s", pub.Remote, pub.RemotePath),
+		"remote": leaseFile,
+	})
+	return err
+}
+
+// startRenewing renews the lease of pub in the background, until
+// stopRenewing is called.
+func (d *driver) startRenewing(pub *publication, expiry time.Time) {
+	d.renewers.start(pub.TargetPath, func(ctx context.Context) {
+		d.renewLease(ctx, pub, expiry)
+	})
+}
+
+func (d *driver) stopRenewing(target string) {
+	d.renewers.stop(target)
+}
+
+// renewLease renews the lease three times per ttl. If the lease is about to
+// expire without being renewed, another node may take it over, so the mount
+// is flipped to read-only.
+func (d *driver) renewLease(ctx context.Context, pub *publication, expiry time.Time) {
+	l := slog.Default().With("volume_id", pub.VolumeID, "target_path", pub.TargetPath)
+	t := time.NewTicker(pub.LeaseTTL / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		next, err := d.acquireLease(ctx, pub)
+		if err == nil {
+			expiry = next
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		l.Warn("failed to renew lease", "err", err, "expiry", expiry)
+		if time.Until(expiry) < pub.LeaseTTL/3 {
+			l.Error("lease lost, flipping the mount to read-only", "err", remountReadonly(pub.TargetPath))
+			return
+		}
+	}
+}
+
+// restoreLeases resumes renewing the leases of writable publications made
+// before a restart of the driver.
+func (d *driver) restoreLeases() {
+	for _, pub := range d.publications.list() {
+		if pub.LeaseTTL > 0 && !pub.Readonly {
+			// the lease may already be lost, the first renewal tells
+			d.startRenewing(pub, time.Now().Add(pub.LeaseTTL/2))
+		}
+	}
+}
+
+// remountReadonly makes the mount point at target read-only, without
+// unmounting it from under the workload.
+func remountReadonly(target string) error {
+	return syscall.Mount("", target, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, "")
+}
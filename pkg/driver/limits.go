@@ -0,0 +1,193 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Volume context keys of per volume limits, in the syntax of the rclone
+// flags of the same name, like "10M:1M" or "08:00,512k 19:00,off" for
+// bwlimit.
+const (
+	bwlimitKey   = "bwlimit"
+	transfersKey = "transfers"
+	checkersKey  = "checkers"
+)
+
+const volumeRcdStartTimeout = 10 * time.Second
+
+// limitArgs returns the rcd flags of the limits of volumeContext.
+func limitArgs(volumeContext map[string]string) ([]string, error) {
+	var args []string
+	if v, ok := volumeContext[bwlimitKey]; ok {
+		args = append(args, "--bwlimit", v)
+	}
+	for _, key := range []string{transfersKey, checkersKey} {
+		v, ok := volumeContext[key]
+		if !ok {
+			continue
+		}
+		if n, err := strconv.ParseUint(v, 10, 16); err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid %s %q", key, v)
+		}
+		args = append(args, "--"+key, v)
+	}
+	return args, nil
+}
+
+// volumeBackends are rclone processes dedicated to a publication, by
+// target path. Bandwidth and transfer limits of rclone apply to a whole
+// process, so a volume with limits is mounted by its own rcd. Volumes
+// served over NFS also get their own rclone serve.
+type volumeBackends struct {
+	mu       sync.Mutex
+	byTarget map[string]rcBackend
+}
+
+// get returns the backend of target, or def.
+func (v *volumeBackends) get(target string, def rcBackend) rcBackend {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if b, ok := v.byTarget[target]; ok {
+		return b
+	}
+	return def
+}
+
+func (v *volumeBackends) stopAll() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var errs []error
+	for target, b := range v.byTarget {
+		errs = append(errs, b.Stop())
+		delete(v.byTarget, target)
+	}
+	return errors.Join(errs...)
+}
+
+// startVolumeBackend starts the rclone process of pub, with the limits of
+// pub, rclone serve if pub is served or rcd otherwise.
+func (d *driver) startVolumeBackend(ctx context.Context, pub *publication) error {
+	if embeddedRclone {
+		return errors.New("per volume rclone processes are not supported with embedded rclone")
+	}
+	d.stopVolumeBackend(pub.TargetPath)
+
+	dir := filepath.Join(d.config.StateDir, "volumes")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	addr := "unix://" + filepath.Join(dir, pub.id()+".sock")
+	pidfile := filepath.Join(dir, pub.id()+".pid")
+	l := slog.Default().With("volume_id", pub.VolumeID, "target_path", pub.TargetPath)
+	args := append(d.rcdArgs(), pub.Limits...)
+	if len(pub.Serve) > 0 {
+		args = append(append([]string{}, pub.Serve...), args...)
+	} else {
+		args = append([]string{"rcd"}, args...)
+	}
+	b, err := newRcloneBackend(l, addr, pidfile, args)
+	if err != nil {
+		return err
+	}
+
+	// rclone exits on invalid flags, or when its address is taken, so wait
+	// until it answers
+	ctx, cancel := context.WithTimeout(ctx, volumeRcdStartTimeout)
+	defer cancel()
+	for {
+		if _, err = d.rcOn(ctx, b, "core/version", nil); err == nil {
+			break
+		}
+		if running, lastErr, _ := b.sup.State(); !running && lastErr != nil {
+			b.Stop()
+			return fmt.Errorf("rclone of volume exited, check its options: %w", lastErr)
+		}
+		select {
+		case <-ctx.Done():
+			if _, lastErr, _ := b.sup.State(); lastErr != nil {
+				err = lastErr
+			}
+			b.Stop()
+			return fmt.Errorf("rclone of volume did not start, check its options: %w", err)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	d.volumeBackends.mu.Lock()
+	d.volumeBackends.byTarget[pub.TargetPath] = b
+	d.volumeBackends.mu.Unlock()
+	return nil
+}
+
+// stopVolumeBackend stops the rcd of target, if any.
+func (d *driver) stopVolumeBackend(target string) error {
+	d.volumeBackends.mu.Lock()
+	b, ok := d.volumeBackends.byTarget[target]
+	delete(d.volumeBackends.byTarget, target)
+	d.volumeBackends.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return b.Stop()
+}
+
+// restoreVolumeBackends restarts the rcd of publications made before a
+// restart of the driver, so that they can be unmounted. The FUSE mounts of
+// the previous rcds are gone with them, and are mounted again.
+func (d *driver) restoreVolumeBackends() {
+	for _, pub := range d.publications.list() {
+		if len(pub.Limits) == 0 && len(pub.Serve) == 0 {
+			continue
+		}
+		l := slog.Default().With("volume_id", pub.VolumeID, "target_path", pub.TargetPath)
+		if err := d.startVolumeBackend(context.Background(), pub); err != nil {
+			l.Error("failed to restart rcd of volume", "err", err)
+			continue
+		}
+		// served volumes are served on the same port again
+		if _, served := d.mounterOf(pub).(servedMounter); served {
+			continue
+		}
+		// the previous rcd unmounts on exit, if it is not killed
+		if ok, err := mounted(pub.TargetPath, d.config.HealthTimeout); ok && err == nil {
+			continue
+		}
+		l.Warn("remounting volume, its rcd exited with the previous run")
+		if err := d.remount(context.Background(), pub); err != nil {
+			l.Error("failed to remount volume", "err", err)
+		}
+	}
+}
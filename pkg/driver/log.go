@@ -0,0 +1,262 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"golang.org/x/net/context"
+)
+
+// SetupLogging installs a JSON logger writing to w as the default logger.
+// All records pass through the secret redactor before being written.
+func SetupLogging(w io.Writer, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	h := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: lvl})
+	slog.SetDefault(slog.New(&redactHandler{h}))
+	return nil
+}
+
+type loggerKey struct{}
+
+// withLogger returns a context carrying l, see logFrom.
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// logFrom returns the request scoped logger of ctx, or the default logger.
+func logFrom(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+			return l
+		}
+	}
+	return slog.Default()
+}
+
+// randomID returns a random hex identifier.
+func randomID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestAttrs extracts the fields used to correlate log lines of a CSI call.
+func requestAttrs(method string, req any) []any {
+	attrs := []any{
+		slog.String("method", method[strings.LastIndex(method, "/")+1:]),
+		slog.String("request_id", randomID()),
+	}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		attrs = append(attrs, slog.String("volume_id", r.GetVolumeId()))
+	}
+	if r, ok := req.(interface{ GetTargetPath() string }); ok && r.GetTargetPath() != "" {
+		attrs = append(attrs, slog.String("target_path", r.GetTargetPath()))
+	}
+	return attrs
+}
+
+const redacted = "***"
+
+// minSecretLen avoids replacing short values like "1" or "s3" everywhere.
+const minSecretLen = 4
+
+// maxSecrets bounds the secrets remembered, and the work of each log
+// record, the least recently added are forgotten first.
+const maxSecrets = 512
+
+var (
+	// secretKey matches option names that hold credentials, like rclone's
+	// "token", "pass", "secret_access_key" or "client_secret".
+	secretKey = regexp.MustCompile(`(?i)(token|pass|secret|key|credential|auth|sas_url|service_account)`)
+	// secretJSON matches `"<secret key>": "<value>"`, also in nested and
+	// escaped JSON strings, as rc echoes its input back on errors.
+	secretJSON = regexp.MustCompile(`((\\*)"[^"\\]*(?i:token|pass|secret|key|credential|auth|sas_url|service_account)[^"\\]*\\*"\s*:\s*)\\*"(?:[^"\\]|\\[^"])*\\*"`)
+)
+
+// redactor remembers secret values seen in volume parameters and secrets so
+// they can be scrubbed from anything that is logged or returned to the CO.
+type redactor struct {
+	mu      sync.RWMutex
+	secrets []string
+	// added is when each secret was last added, by a sequence number
+	added map[string]uint64
+	seq   uint64
+}
+
+var secrets = &redactor{}
+
+// Add registers values that must never show up in logs.
+func (r *redactor) Add(values ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.added == nil {
+		r.added = make(map[string]uint64)
+	}
+	for _, v := range values {
+		if len(v) < minSecretLen {
+			continue
+		}
+		r.seq++
+		if _, ok := r.added[v]; !ok {
+			r.secrets = append(r.secrets, v)
+		}
+		r.added[v] = r.seq
+	}
+	for len(r.secrets) > maxSecrets {
+		oldest := 0
+		for i, v := range r.secrets {
+			if r.added[v] < r.added[r.secrets[oldest]] {
+				oldest = i
+			}
+		}
+		delete(r.added, r.secrets[oldest])
+		r.secrets = slices.Delete(r.secrets, oldest, oldest+1)
+	}
+	// longest first, so that a secret containing another is fully removed
+	sort.SliceStable(r.secrets, func(i, j int) bool {
+		return len(r.secrets[i]) > len(r.secrets[j])
+	})
+}
+
+// AddParameters registers the values of secret looking keys of a JSON object
+// of rclone remote parameters.
+func (r *redactor) AddParameters(parameters string) {
+	gjson.Parse(parameters).ForEach(func(k, v gjson.Result) bool {
+		if secretKey.MatchString(k.String()) {
+			r.Add(v.String())
+		}
+		return true
+	})
+}
+
+// String returns s with every known secret replaced.
+func (r *redactor) String(s string) string {
+	s = secretJSON.ReplaceAllString(s, `$1$2"`+redacted+`$2"`)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, secret := range r.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}
+
+// redactHandler scrubs secrets from messages and attributes.
+type redactHandler struct {
+	slog.Handler
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	nr := slog.NewRecord(r.Time, r.Level, secrets.String(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		nr.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, nr)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = redactAttr(a)
+	}
+	return &redactHandler{h.Handler.WithAttrs(redactedAttrs)}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{h.Handler.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, secrets.String(v.String()))
+	case slog.KindAny:
+		return slog.String(a.Key, secrets.String(fmt.Sprintf("%+v", v.Any())))
+	case slog.KindGroup:
+		g := v.Group()
+		attrs := make([]any, 0, len(g))
+		for _, ga := range g {
+			attrs = append(attrs, redactAttr(ga))
+		}
+		return slog.Group(a.Key, attrs...)
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// relayRcdLog re-emits the json log lines of rcd read from r.
+func relayRcdLog(r io.Reader, l *slog.Logger) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := s.Bytes()
+		var entry map[string]any
+		if err := json.Unmarshal(line, &entry); err != nil {
+			l.Info(string(line))
+			continue
+		}
+		msg, _ := entry["msg"].(string)
+		level, _ := entry["level"].(string)
+		attrs := []any{}
+		for k, v := range entry {
+			switch k {
+			case "msg", "level", "time":
+			default:
+				attrs = append(attrs, slog.Any(k, v))
+			}
+		}
+		l.Log(context.Background(), rcloneLevel(level), strings.TrimSpace(msg), attrs...)
+	}
+}
+
+func rcloneLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warning", "warn":
+		return slog.LevelWarn
+	case "error", "critical", "alert", "emergency":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,92 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	r := &redactor{}
+	r.Add("abcdefgh", "bcdefg", "s3", "abcdefgh")
+	r.AddParameters(`{"type":"s3","secret_access_key":"hunter22","region":"eu-west-1"}`)
+
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "key is hunter22", "key is ***"},
+		{"nested secret", "abcdefgh", "***"},
+		{"inner secret", "xbcdefgx", "x***x"},
+		{"short values", "type s3", "type s3"},
+		{"not a secret", "region eu-west-1", "region eu-west-1"},
+		{"json", `{"pass": "unknown1"}`, `{"pass": "***"}`},
+		{"escaped json", `{"parameters":"{\"client_secret\":\"unknown2\",\"type\":\"drive\"}"}`, `{"parameters":"{\"client_secret\":\"***\",\"type\":\"drive\"}"}`},
+		{"double escaped json", `"{\\\"token\\\":\\\"unknown3\\\"}"`, `"{\\\"token\\\":\\\"***\\\"}"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.String(tt.in); got != tt.want {
+				t.Errorf("String(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+	if len(r.secrets) != 3 {
+		t.Errorf("secrets = %q, want 3 distinct secrets", r.secrets)
+	}
+}
+
+func TestRedactorForgetsOldestSecrets(t *testing.T) {
+	r := &redactor{}
+	r.Add("secret-first")
+	for i := 0; i < maxSecrets; i++ {
+		r.Add(fmt.Sprintf("secret-%04d", i))
+		// still in use, added again by every publication
+		r.Add("secret-first")
+	}
+	if len(r.secrets) != maxSecrets {
+		t.Errorf("remembers %d secrets, want %d", len(r.secrets), maxSecrets)
+	}
+	if got := r.String("secret-first secret-0000 secret-0001"); got != "*** secret-0000 ***" {
+		t.Errorf("got %q, want the least recently added secret forgotten", got)
+	}
+}
+
+func TestRedactHandlerWithAttrs(t *testing.T) {
+	secrets.Add("hunter33")
+	var b bytes.Buffer
+	attrs := []slog.Attr{slog.String("pass", "hunter33")}
+	h := (&redactHandler{slog.NewJSONHandler(&b, nil)}).WithAttrs(attrs)
+	slog.New(h).Info("msg")
+	if strings.Contains(b.String(), "hunter33") {
+		t.Errorf("secret is logged: %s", b.String())
+	}
+	if attrs[0].Value.String() != "hunter33" {
+		t.Errorf("the attrs of the caller are changed to %v", attrs[0])
+	}
+}
@@ -0,0 +1,238 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+// mounterKey selects how a volume is mounted.
+const mounterKey = "mounter"
+
+const (
+	mounterFUSE   = "fuse"
+	mounterNFS    = "nfs"
+	mounterWebDAV = "webdav"
+	mounterCopy   = "copy"
+	mounterBisync = "bisync"
+	mounterBind   = "bind"
+)
+
+// mounter makes the remote path of publications available at their
+// target. The CSI handlers are shared by all mounters, which are looked up
+// by name in the mounters of the driver.
+type mounter interface {
+	Mount(ctx context.Context, pub *publication, vfsOpt, mountOpt map[string]any) error
+	Unmount(ctx context.Context, pub *publication) error
+	IsMounted(pub *publication) (bool, error)
+	Stats(ctx context.Context, pub *publication) ([]*csi.VolumeUsage, error)
+	// Ready checks the prerequisites of the mounter on the node.
+	Ready() error
+}
+
+// newMounters returns the mounters of d, by name.
+func newMounters(d *driver) map[string]mounter {
+	return map[string]mounter{
+		mounterFUSE:   fuseMounter{d},
+		mounterNFS:    servedMounter{d, mounterNFS},
+		mounterWebDAV: servedMounter{d, mounterWebDAV},
+		mounterCopy:   copyMounter{d},
+		mounterBisync: copyMounter{d},
+		mounterBind:   stagedMounter{d},
+	}
+}
+
+// mounterOptions parses how the volume of volumeContext is mounted, def
+// if not set. opts is only set for local copies.
+func mounterOptions(volumeContext map[string]string, def string) (name string, opts *copyOptions, err error) {
+	name = volumeContext[mounterKey]
+	if name == "" {
+		name = def
+	}
+	switch name {
+	case mounterFUSE, mounterNFS, mounterWebDAV, mounterBind:
+		for _, key := range []string{syncBackKey, syncIntervalKey, conflictKey} {
+			if _, ok := volumeContext[key]; ok {
+				return "", nil, fmt.Errorf("%s is only supported by %s=%s or %s", key, mounterKey, mounterCopy, mounterBisync)
+			}
+		}
+	case mounterCopy:
+		opts, err = parseCopyOptions(volumeContext)
+	case mounterBisync:
+		opts, err = bisyncOptions(volumeContext)
+	default:
+		err = fmt.Errorf("unknown %s %q", mounterKey, name)
+	}
+	return name, opts, err
+}
+
+// mounterOf returns the mounter of pub, publications recorded before
+// mounters existed are FUSE mounts.
+func (d *driver) mounterOf(pub *publication) mounter {
+	if m, ok := d.mounters[pub.Mounter]; ok {
+		return m
+	}
+	return d.mounters[mounterFUSE]
+}
+
+// fuseMounter mounts volumes with rclone mount.
+type fuseMounter struct {
+	d *driver
+}
+
+func (m fuseMounter) Mount(ctx context.Context, pub *publication, vfsOpt, mountOpt map[string]any) error {
+	// a stale mount fails everything on target, unmount it first
+	if err := m.Unmount(ctx, pub); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(pub.TargetPath, 0755); err != nil {
+		return err
+	}
+	vb, err := json.Marshal(vfsOpt)
+	if err != nil {
+		return err
+	}
+	mb, err := json.Marshal(mountOpt)
+	if err != nil {
+		return err
+	}
+	_, err = m.d.rcTarget(ctx, pub.TargetPath, "mount/mount", map[string]any{
+		"fs":         fmt.Sprintf("%s:%s", pub.Remote, pub.RemotePath),
+		"mountPoint": pub.TargetPath,
+		"mountOpt":   string(mb),
+		"vfsOpt":     string(vb),
+	})
+	return err
+}
+
+func (m fuseMounter) Unmount(ctx context.Context, pub *publication) error {
+	ok, err := m.IsMounted(pub)
+	if errors.Is(err, errStaleMount) {
+		// rclone lost the mount, with the rclone which served it
+		logFrom(ctx).Warn("unmounting stale mount lazily", "target_path", pub.TargetPath)
+		return unmountStale(pub.TargetPath)
+	}
+	// mounts failing the stat otherwise, e.g. with EIO, are unmounted too
+	if !ok {
+		return err
+	}
+	_, err = m.d.rcTarget(ctx, pub.TargetPath, "mount/unmount", map[string]any{"mountPoint": pub.TargetPath})
+	if err != nil && strings.Contains(err.Error(), "mount not found") {
+		// rclone forgets mounts replaced by a remount when the old one ends
+		return unmount(pub.TargetPath, m.d.config.HealthTimeout)
+	}
+	return err
+}
+
+func (m fuseMounter) IsMounted(pub *publication) (bool, error) {
+	return mounted(pub.TargetPath, m.d.config.HealthTimeout)
+}
+
+func (m fuseMounter) Stats(ctx context.Context, pub *publication) ([]*csi.VolumeUsage, error) {
+	return statfsUsage(pub.TargetPath)
+}
+
+func (m fuseMounter) Ready() error {
+	return checkFuse()
+}
+
+// bindMounter bind mounts the local directory returned by Source to the
+// target. Local copies are mounted with it. Timeout is the time the mount
+// has to answer before it is considered stale.
+type bindMounter struct {
+	Source  func(pub *publication) string
+	Timeout time.Duration
+}
+
+func (m bindMounter) Mount(ctx context.Context, pub *publication, vfsOpt, mountOpt map[string]any) error {
+	return bindMount(m.Source(pub), pub.TargetPath, pub.Readonly)
+}
+
+func (m bindMounter) Unmount(ctx context.Context, pub *publication) error {
+	return unmount(pub.TargetPath, m.Timeout)
+}
+
+func (m bindMounter) IsMounted(pub *publication) (bool, error) {
+	return mounted(pub.TargetPath, m.Timeout)
+}
+
+func (m bindMounter) Stats(ctx context.Context, pub *publication) ([]*csi.VolumeUsage, error) {
+	return statfsUsage(pub.TargetPath)
+}
+
+func (m bindMounter) Ready() error {
+	return nil
+}
+
+// bindMount mounts src to target, read-only if readonly is set.
+func bindMount(src, target string, readonly bool) error {
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount(src, target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind mount %s: %w", target, err)
+	}
+	if readonly {
+		// bind mounts ignore MS_RDONLY, until remounted
+		if err := syscall.Mount("", target, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+			return errors.Join(fmt.Errorf("remount %s read-only: %w", target, err), syscall.Unmount(target, 0))
+		}
+	}
+	return nil
+}
+
+// statfsUsage returns the usage of the filesystem mounted at target.
+func statfsUsage(target string) ([]*csi.VolumeUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(target, &st); err != nil {
+		return nil, err
+	}
+	bsize := int64(st.Bsize)
+	usage := []*csi.VolumeUsage{{
+		Unit:      csi.VolumeUsage_BYTES,
+		Total:     int64(st.Blocks) * bsize,
+		Used:      int64(st.Blocks-st.Bfree) * bsize,
+		Available: int64(st.Bavail) * bsize,
+	}}
+	// remotes without inodes report none
+	if st.Files > 0 {
+		usage = append(usage, &csi.VolumeUsage{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(st.Files),
+			Used:      int64(st.Files - st.Ffree),
+			Available: int64(st.Ffree),
+		})
+	}
+	return usage, nil
+}
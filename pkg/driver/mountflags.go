@@ -0,0 +1,98 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// mountFlagOpts are mount flags that map to rclone mount options.
+var mountFlagOpts = map[string]struct {
+	opt   string
+	value any
+}{
+	"allow_other":         {"AllowOther", true},
+	"allow_root":          {"AllowRoot", true},
+	"default_permissions": {"DefaultPermissions", true},
+	"async_read":          {"AsyncRead", true},
+	"sync_read":           {"AsyncRead", false},
+	"writeback_cache":     {"WritebackCache", true},
+}
+
+// mountFlagExtra are mount flags passed as is to the FUSE mount.
+var mountFlagExtra = map[string]bool{
+	"noatime":     true,
+	"nodiratime":  true,
+	"relatime":    true,
+	"strictatime": true,
+	"nosuid":      true,
+	"nodev":       true,
+	"noexec":      true,
+	"dirsync":     true,
+}
+
+// mountFlagOptions translates the mount flags of a volume capability into
+// rclone options, and tells if they make the mount read-only. Flags that can
+// not be honored are rejected, rather than silently dropped.
+func mountFlagOptions(flags []string, vfsOpt, mountOpt map[string]any) (readonly bool, err error) {
+	extra := []any{}
+	if v, ok := mountOpt["ExtraOptions"].([]any); ok {
+		extra = v
+	}
+	for _, f := range flags {
+		f = strings.TrimSpace(f)
+		k, v, hasValue := strings.Cut(f, "=")
+		switch {
+		case f == "ro":
+			readonly = true
+			vfsOpt["ReadOnly"] = true
+		case f == "rw" || f == "":
+		case mountFlagExtra[f]:
+			extra = append(extra, f)
+		case hasValue && (k == "uid" || k == "gid" || k == "umask"):
+			base := 10
+			if k == "umask" {
+				base = 8
+			}
+			n, err := strconv.ParseUint(v, base, 32)
+			if err != nil {
+				return false, fmt.Errorf("invalid mount flag %q: %w", f, err)
+			}
+			vfsOpt[map[string]string{"uid": "UID", "gid": "GID", "umask": "Umask"}[k]] = n
+		default:
+			o, ok := mountFlagOpts[f]
+			if !ok {
+				return false, fmt.Errorf("unsupported mount flag %q", f)
+			}
+			mountOpt[o.opt] = o.value
+		}
+	}
+	if len(extra) > 0 {
+		mountOpt["ExtraOptions"] = extra
+	}
+	return readonly, nil
+}
@@ -0,0 +1,221 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+// errStaleMount is returned for mounts whose filesystem is gone, like FUSE
+// mounts of an rclone which exited, they answer ENOTCONN to everything.
+var errStaleMount = errors.New("stale mount")
+
+// mountInfo is an entry of /proc/self/mountinfo, see proc(5).
+type mountInfo struct {
+	ID         int
+	Parent     int
+	Root       string
+	MountPoint string
+	Options    string
+	FSType     string
+	Source     string
+}
+
+// parseMountInfo parses the mountinfo format of r.
+func parseMountInfo(r io.Reader) ([]mountInfo, error) {
+	var mounts []mountInfo
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" {
+			continue
+		}
+		// optional fields end with a lone "-"
+		pre, post, ok := strings.Cut(line, " - ")
+		if !ok {
+			return nil, fmt.Errorf("invalid mountinfo line %q", line)
+		}
+		f := strings.Fields(pre)
+		g := strings.Fields(post)
+		if len(f) < 6 || len(g) < 2 {
+			return nil, fmt.Errorf("invalid mountinfo line %q", line)
+		}
+		m := mountInfo{
+			Root:       unescapeMountInfo(f[3]),
+			MountPoint: unescapeMountInfo(f[4]),
+			Options:    f[5],
+			FSType:     g[0],
+			Source:     unescapeMountInfo(g[1]),
+		}
+		var err error
+		if m.ID, err = strconv.Atoi(f[0]); err != nil {
+			return nil, fmt.Errorf("invalid mountinfo line %q", line)
+		}
+		if m.Parent, err = strconv.Atoi(f[1]); err != nil {
+			return nil, fmt.Errorf("invalid mountinfo line %q", line)
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, s.Err()
+}
+
+// unescapeMountInfo decodes the octal escapes of space, tab, newline and
+// backslash in mountinfo fields.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// findMount returns the topmost mount of target in mounts, if any.
+func findMount(mounts []mountInfo, target string) *mountInfo {
+	target = filepath.Clean(target)
+	var found *mountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint == target {
+			found = &mounts[i]
+		}
+	}
+	return found
+}
+
+// mounted tells whether target is a mount point. Stale mounts, and mounts
+// which do not answer a stat within timeout, are mounted, with
+// errStaleMount. Mounts failing the stat otherwise are mounted, with its
+// error.
+func mounted(target string, timeout time.Duration) (bool, error) {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	mounts, err := parseMountInfo(f)
+	if err != nil {
+		return false, err
+	}
+	m := findMount(mounts, target)
+	if m == nil {
+		return false, nil
+	}
+	// a hung FUSE server blocks the stat, until the mount is aborted
+	st := statMount(m)
+	select {
+	case <-st.done:
+		if errors.Is(st.err, syscall.ENOTCONN) {
+			return true, fmt.Errorf("%s: %w", target, errStaleMount)
+		}
+		if st.err != nil {
+			return true, fmt.Errorf("stat %s: %w", target, st.err)
+		}
+	case <-time.After(timeout):
+		return true, fmt.Errorf("%s: no answer within %s: %w", target, timeout, errStaleMount)
+	}
+	return true, nil
+}
+
+// mountStat is a stat of a mount point, err is set once done is closed.
+type mountStat struct {
+	done chan struct{}
+	err  error
+}
+
+// mountStats are the stats in flight, by mount id.
+var mountStats = struct {
+	sync.Mutex
+	byID map[int]*mountStat
+}{byID: make(map[int]*mountStat)}
+
+// statMount stats the mount point of m, or returns the stat of m still in
+// flight: a hung mount blocks one goroutine, not one more per check. Mounts
+// replacing it at the same mount point get new ids, and stats of their own.
+func statMount(m *mountInfo) *mountStat {
+	mountStats.Lock()
+	defer mountStats.Unlock()
+	if st, ok := mountStats.byID[m.ID]; ok {
+		return st
+	}
+	st := &mountStat{done: make(chan struct{})}
+	mountStats.byID[m.ID] = st
+	go func() {
+		var s syscall.Stat_t
+		st.err = syscall.Stat(m.MountPoint, &s)
+		mountStats.Lock()
+		delete(mountStats.byID, m.ID)
+		mountStats.Unlock()
+		close(st.done)
+	}()
+	return st
+}
+
+// unmountStale lazily unmounts the stale mount of target, like umount -l
+// or fusermount -uz: it is detached now and cleaned up by the kernel once
+// unused.
+func unmountStale(target string) error {
+	if err := syscall.Unmount(target, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("lazy unmount %s: %w", target, err)
+	}
+	return nil
+}
+
+// unmount unmounts target if mounted, lazily if it is stale or does not
+// answer within timeout.
+func unmount(target string, timeout time.Duration) error {
+	ok, err := mounted(target, timeout)
+	if errors.Is(err, errStaleMount) {
+		return unmountStale(target)
+	}
+	// mounts failing the stat otherwise, e.g. with EIO, are unmounted too
+	if !ok {
+		return err
+	}
+	if err := syscall.Unmount(target, 0); err != nil {
+		return fmt.Errorf("unmount %s: %w", target, err)
+	}
+	return nil
+}
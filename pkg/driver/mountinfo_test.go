@@ -0,0 +1,163 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const sampleMountInfo = `22 1 0:21 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+23 22 0:22 / /proc rw,nosuid,nodev,noexec,relatime shared:2 - proc proc rw
+31 22 0:31 / /var/lib/kubelet/pods/p1/volumes/kubernetes.io~csi/pv\040one/mount rw,nosuid,nodev,relatime shared:15 - fuse.rclone remote\040a:path rw,user_id=0,group_id=0
+32 22 0:32 /copies/abc /var/lib/kubelet/target rw,relatime - ext4 /dev/sda1 rw
+33 32 0:33 / /var/lib/kubelet/target ro,nosuid,nodev,relatime shared:16 master:3 - fuse.rclone vol:data rw,user_id=0,group_id=0
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := parseMountInfo(strings.NewReader(sampleMountInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []mountInfo{
+		{22, 1, "/", "/", "rw,relatime", "ext4", "/dev/sda1"},
+		{23, 22, "/", "/proc", "rw,nosuid,nodev,noexec,relatime", "proc", "proc"},
+		{31, 22, "/", "/var/lib/kubelet/pods/p1/volumes/kubernetes.io~csi/pv one/mount", "rw,nosuid,nodev,relatime", "fuse.rclone", "remote a:path"},
+		{32, 22, "/copies/abc", "/var/lib/kubelet/target", "rw,relatime", "ext4", "/dev/sda1"},
+		{33, 32, "/", "/var/lib/kubelet/target", "ro,nosuid,nodev,relatime", "fuse.rclone", "vol:data"},
+	}
+	if !reflect.DeepEqual(mounts, want) {
+		t.Errorf("got %+v, want %+v", mounts, want)
+	}
+}
+
+func TestParseMountInfoMalformed(t *testing.T) {
+	tests := []struct {
+		name, line string
+	}{
+		{"no separator", "22 1 0:21 / / rw,relatime shared:1 ext4 /dev/sda1 rw"},
+		{"short fields", "22 1 0:21 / / - ext4 /dev/sda1 rw"},
+		{"no source", "22 1 0:21 / / rw,relatime - ext4"},
+		{"invalid id", "x 1 0:21 / / rw,relatime - ext4 /dev/sda1 rw"},
+		{"invalid parent", "22 x 0:21 / / rw,relatime - ext4 /dev/sda1 rw"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseMountInfo(strings.NewReader(sampleMountInfo + tt.line + "\n")); err == nil {
+				t.Errorf("%q is accepted", tt.line)
+			}
+		})
+	}
+}
+
+func TestUnescapeMountInfo(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`/plain`, "/plain"},
+		{`/with\040space`, "/with space"},
+		{`/tab\011and\012newline`, "/tab\tand\nnewline"},
+		{`/back\134slash`, `/back\slash`},
+		{`/end\040`, "/end "},
+		{`/short\04`, `/short\04`},
+		{`/not\999octal`, `/not\999octal`},
+		{`/lone\`, `/lone\`},
+	}
+	for _, tt := range tests {
+		if got := unescapeMountInfo(tt.in); got != tt.want {
+			t.Errorf("unescapeMountInfo(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFindMount(t *testing.T) {
+	mounts, err := parseMountInfo(strings.NewReader(sampleMountInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, target string
+		id           int
+	}{
+		{"root", "/", 22},
+		{"escaped", "/var/lib/kubelet/pods/p1/volumes/kubernetes.io~csi/pv one/mount", 31},
+		{"stacked, topmost wins", "/var/lib/kubelet/target", 33},
+		{"unclean path", "/var/lib/kubelet/target/", 33},
+		{"not a mount point", "/var/lib/kubelet", 0},
+		{"below a mount point", "/proc/self", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := findMount(mounts, tt.target)
+			if tt.id == 0 {
+				if m != nil {
+					t.Errorf("found %+v", m)
+				}
+				return
+			}
+			if m == nil || m.ID != tt.id {
+				t.Errorf("got %+v, want mount %d", m, tt.id)
+			}
+		})
+	}
+}
+
+func TestMountedHungMount(t *testing.T) {
+	// a FUSE mount whose server never answers
+	dir := t.TempDir()
+	f, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		t.Skipf("no FUSE: %v", err)
+	}
+	defer f.Close()
+	if err := syscall.Mount("hung", dir, "fuse", 0, fmt.Sprintf("fd=%d,rootmode=40000,user_id=0,group_id=0", f.Fd())); err != nil {
+		t.Skipf("can not mount: %v", err)
+	}
+	defer syscall.Unmount(dir, syscall.MNT_DETACH)
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 3; i++ {
+		ok, err := mounted(dir, 50*time.Millisecond)
+		if !ok || !errors.Is(err, errStaleMount) {
+			t.Fatalf("got %v, %v, want a stale mount", ok, err)
+		}
+	}
+	if n := runtime.NumGoroutine() - before; n > 1 {
+		t.Errorf("%d stats are blocked on the mount, want 1", n)
+	}
+	if err := unmount(dir, 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := mounted(dir, 50*time.Millisecond); ok || err != nil {
+		t.Errorf("got %v, %v after unmounting", ok, err)
+	}
+}
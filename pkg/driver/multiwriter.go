@@ -0,0 +1,89 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+// Volume context keys of MULTI_NODE_MULTI_WRITER volumes.
+const (
+	// multiWriterKey must be set to multiWriterAck, acknowledging that
+	// concurrent writers of the same file overwrite each other.
+	multiWriterKey = "multiWriter"
+	multiWriterAck = "last-writer-wins"
+	// isolationKey set to "node" gives every node its own subdirectory.
+	isolationKey  = "multiWriterIsolation"
+	isolationNode = "node"
+)
+
+// multiWriterDirCacheTime keeps listings of other writers from being stale
+// for long.
+const multiWriterDirCacheTime = 5 * time.Second
+
+// checkMultiWriter returns why volumeContext can not be used with
+// MULTI_NODE_MULTI_WRITER, if any.
+func checkMultiWriter(volumeContext map[string]string) error {
+	if volumeContext[multiWriterKey] != multiWriterAck {
+		return fmt.Errorf("%s requires %s=%s in the volume context, to acknowledge that rclone has last writer wins semantics", csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, multiWriterKey, multiWriterAck)
+	}
+	switch v := volumeContext[isolationKey]; v {
+	case "", isolationNode:
+	default:
+		return fmt.Errorf("unknown %s %q", isolationKey, v)
+	}
+	return nil
+}
+
+// multiWriterOptions configures the VFS for several writers: no write
+// caching, so that writes reach the remote on close, and short lived
+// directory caches refreshed on mount. It returns the remote path to mount,
+// which is a per node subdirectory when isolated.
+func (d *driver) multiWriterOptions(ctx context.Context, remote, rpath string, volumeContext map[string]string, vfsOpt map[string]any) (string, error) {
+	for k, v := range map[string]any{
+		"CacheMode":    "off",
+		"DirCacheTime": int64(multiWriterDirCacheTime),
+		"Refresh":      true,
+	} {
+		if old, ok := vfsOpt[k]; ok && old != v {
+			logFrom(ctx).Warn("overriding vfs option for multi writer volume", "option", k, "value", old)
+		}
+		vfsOpt[k] = v
+	}
+	if volumeContext[isolationKey] != isolationNode {
+		return rpath, nil
+	}
+	rpath = path.Join(rpath, d.config.NodeID)
+	_, err := d.rc(ctx, "operations/mkdir", map[string]any{
+		"fs":     fmt.Sprintf("%s:", remote),
+		"remote": rpath,
+	})
+	return rpath, err
+}
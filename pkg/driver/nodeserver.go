@@ -27,10 +27,12 @@ package driver
 import (
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func (d *driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
@@ -50,9 +52,21 @@ func (d *driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 
 func (d *driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	var err error
+	var readonly bool
+	var parameters string
+	var expiry time.Time
+	var prewarm []string
+	var prewarmTimeout time.Duration
+	var created bool
 	rpath := "/"
 	vfsOpt := make(map[string]any)
 	mountOpt := make(map[string]any)
+	pub := &publication{
+		VolumeID:   req.VolumeId,
+		TargetPath: req.TargetPath,
+		AccessMode: req.GetVolumeCapability().GetAccessMode().GetMode(),
+	}
+	pub.Readonly = req.Readonly || readerOnly(pub.AccessMode)
 	if v, ok := req.VolumeContext["path"]; ok {
 		rpath = v
 	}
@@ -61,31 +75,250 @@ func (d *driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 			goto clean
 		}
 	}
-	if req.Readonly {
-		vfsOpt["ReadOnly"] = true
-	}
 	if v, ok := req.VolumeContext["mount"]; ok {
 		if err = json.Unmarshal([]byte(v), &mountOpt); err != nil {
 			goto clean
 		}
 	}
-	if _, err = d.remoteCreate(req.VolumeId, req.VolumeContext["parameters"]); err != nil {
+	if readonly, err = mountFlagOptions(req.VolumeCapability.GetMount().GetMountFlags(), vfsOpt, mountOpt); err != nil {
+		err = status.Error(codes.InvalidArgument, err.Error())
+		goto clean
+	}
+	pub.Readonly = pub.Readonly || readonly
+	if pub.Readonly {
+		vfsOpt["ReadOnly"] = true
+	}
+	if err = ownershipOptions(req.VolumeContext, req.VolumeCapability, vfsOpt, mountOpt); err != nil {
+		err = status.Error(codes.InvalidArgument, err.Error())
+		goto clean
+	}
+	if err = d.cacheOptions(pub, req.VolumeContext, vfsOpt); err != nil {
+		err = status.Error(codes.InvalidArgument, err.Error())
 		goto clean
 	}
-	_, err = d.remoteMount(req.VolumeId, rpath, req.TargetPath, vfsOpt, mountOpt)
+	if prewarm, prewarmTimeout, err = prewarmOptions(req.VolumeContext); err != nil {
+		err = status.Error(codes.InvalidArgument, err.Error())
+		goto clean
+	}
+	if pub.Mounter, pub.Copy, err = mounterOptions(req.VolumeContext, d.config.DefaultMounter); err != nil {
+		err = status.Error(codes.InvalidArgument, err.Error())
+		goto clean
+	}
+	if pub.Copy != nil && len(prewarm) > 0 {
+		err = status.Errorf(codes.InvalidArgument, "%s is not supported by local copies", prewarmKey)
+		goto clean
+	}
+	if pub.Limits, err = limitArgs(req.VolumeContext); err != nil {
+		err = status.Error(codes.InvalidArgument, err.Error())
+		goto clean
+	}
+	if len(pub.Limits) > 0 && pub.Mounter == mounterBind {
+		// the rcd of the volume would exit with its first publication
+		err = status.Errorf(codes.InvalidArgument, "per volume limits are not supported by %s=%s", mounterKey, mounterBind)
+		goto clean
+	}
+	if len(pub.Limits) > 0 && embeddedRclone {
+		err = status.Error(codes.InvalidArgument, "per volume limits are not supported with embedded rclone")
+		goto clean
+	}
+	pub.Remote = req.VolumeId
+	parameters = req.VolumeContext["parameters"]
+	if req.VolumeContext[ephemeralKey] == "true" {
+		// inline volumes are not attached by the controller
+		pub.Ephemeral = true
+		pub.Remote = ephemeralRemote(req.VolumeId)
+		if parameters, err = mergeSecrets(parameters, req.Secrets); err != nil {
+			err = status.Errorf(codes.InvalidArgument, "invalid parameters: %s", err)
+			goto clean
+		}
+		if err = checkInlineBackend(parameters, d.config.InlineBackends); err != nil {
+			err = status.Error(codes.InvalidArgument, err.Error())
+			goto clean
+		}
+	}
+	if pub.AccessMode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
+		if err = checkMultiWriter(req.VolumeContext); err != nil {
+			err = status.Error(codes.InvalidArgument, err.Error())
+			goto clean
+		}
+	}
+	if pub.LeaseTTL, err = parseLease(req.VolumeContext); err != nil {
+		err = status.Error(codes.InvalidArgument, err.Error())
+		goto clean
+	}
+	if pub.LeaseTTL > 0 && pub.AccessMode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
+		err = status.Errorf(codes.InvalidArgument, "%s can not be used with multiple writers", leaseKey)
+		goto clean
+	}
+	if old := d.publications.get(req.TargetPath); old != nil {
+		// a retry, the state of the publication is not this call's to change
+		err = d.republish(ctx, old, pub, vfsOpt, mountOpt)
+		goto clean
+	}
+	if err = d.mounterOf(pub).Ready(); err != nil {
+		err = status.Errorf(codes.FailedPrecondition, "%s volumes can not be mounted on the node: %s", pub.Mounter, err)
+		goto clean
+	}
+	if _, err = d.remoteCreate(ctx, pub.Remote, parameters); err != nil {
+		goto clean
+	}
+	created = true
+	if d.config.Attach && !pub.Ephemeral {
+		if err = d.verifyPublishContext(ctx, pub, rpath, req.PublishContext); err != nil {
+			goto clean
+		}
+	}
+	if pub.AccessMode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER {
+		if rpath, err = d.multiWriterOptions(ctx, pub.Remote, rpath, req.VolumeContext, vfsOpt); err != nil {
+			goto clean
+		}
+	}
+	pub.RemotePath = rpath
+	// volumes with their own rcd are mounted again when it is restarted
+	if pub.Remount = req.VolumeContext[remountKey] == "true"; pub.Remount || len(pub.Limits) > 0 {
+		pub.VfsOpt, pub.MountOpt = vfsOpt, mountOpt
+	}
+	if err = d.publications.add(pub, singleWriter(pub), d.cacheBudget(pub)); err != nil {
+		goto clean
+	}
+	if pub.LeaseTTL > 0 && !pub.Readonly {
+		if expiry, err = d.acquireLease(ctx, pub); err != nil {
+			goto unpublish
+		}
+	}
+	// served volumes have their own rclone anyway
+	if _, served := d.mounterOf(pub).(servedMounter); len(pub.Limits) > 0 && !served {
+		if err = d.startVolumeBackend(ctx, pub); err != nil {
+			err = status.Error(codes.Unavailable, err.Error())
+			goto unpublish
+		}
+	}
+	if err = d.mounterOf(pub).Mount(ctx, pub, vfsOpt, mountOpt); err != nil {
+		goto unpublish
+	}
+	if pub.LeaseTTL > 0 && !pub.Readonly {
+		d.startRenewing(pub, expiry)
+	}
+	d.startChecking(pub)
+	if len(prewarm) > 0 {
+		if !fullCache(vfsOpt) {
+			logFrom(ctx).Warn("file data is only cached with CacheMode full, warming up directories only")
+		}
+		d.startPrewarm(ctx, pub, prewarm, prewarmTimeout, fullCache(vfsOpt))
+	}
+	goto clean
+unpublish:
+	if e := d.stopVolumeBackend(req.TargetPath); e != nil {
+		logFrom(ctx).Error("failed to stop rclone of volume", "err", e)
+	}
+	if !expiry.IsZero() {
+		if e := d.releaseLease(ctx, pub); e != nil {
+			logFrom(ctx).Error("failed to release lease", "err", e)
+		}
+	}
+	if _, e := d.publications.remove(req.TargetPath); e != nil {
+		logFrom(ctx).Error("failed to forget publication", "err", e)
+	}
 clean:
-	glog.V(5).Infof("publish volume: %+v", err)
+	// the remote of an inline volume holds the secrets of the pod, unless
+	// a previous publication still uses it
+	if err != nil && created && pub.Ephemeral && d.publications.get(req.TargetPath) == nil && !d.publications.shared(pub) {
+		if e := d.removeEphemeral(ctx, pub); e != nil {
+			logFrom(ctx).Error("failed to remove inline volume", "err", e)
+		}
+	}
+	logFrom(ctx).Debug("publish volume", "err", err)
 	return &csi.NodePublishVolumeResponse{}, err
 }
 
+// republish answers a publication of the target of old again: it succeeds
+// if pub matches old, mounting old again if its mount is gone.
+func (d *driver) republish(ctx context.Context, old, pub *publication, vfsOpt, mountOpt map[string]any) error {
+	mounter := func(p *publication) string {
+		if p.Mounter == "" {
+			return mounterFUSE
+		}
+		return p.Mounter
+	}
+	if old.VolumeID != pub.VolumeID || old.Readonly != pub.Readonly || old.AccessMode != pub.AccessMode ||
+		old.Ephemeral != pub.Ephemeral || old.LeaseTTL != pub.LeaseTTL || mounter(old) != mounter(pub) {
+		return status.Errorf(codes.AlreadyExists, "%s is already published with another volume or capability", old.TargetPath)
+	}
+	if ok, err := d.mounterOf(old).IsMounted(old); err == nil && ok {
+		return nil
+	}
+	logFrom(ctx).Warn("mounting again a publication which is not mounted anymore")
+	return d.mounterOf(old).Mount(ctx, old, vfsOpt, mountOpt)
+}
+
 func (d *driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	_, err := d.remoteUmount(req.TargetPath)
-	glog.V(5).Infof("unpublish volume: %+v", err)
+	var err error
+	var dropCache, unmounted bool
+	// a check would remount the target, the cache warm-up keeps files busy
+	d.stopPrewarm(req.TargetPath)
+	d.stopChecking(req.TargetPath)
+	paused := d.pauses.stop(req.TargetPath)
+	pub := d.publications.get(req.TargetPath)
+	if pub != nil {
+		// the rcd of a volume with limits exits with the mount
+		if dropCache = d.dropsCache(pub); pub.Copy == nil && (dropCache || len(pub.Limits) > 0) {
+			if err = d.waitUploads(ctx, pub); err != nil {
+				goto clean
+			}
+		}
+	}
+	if pub != nil {
+		err = d.mounterOf(pub).Unmount(ctx, pub)
+	} else {
+		// unknown to the driver, FUSE is the most likely
+		err = d.mounters[mounterFUSE].Unmount(ctx, &publication{TargetPath: req.TargetPath})
+	}
+	if err != nil || pub == nil {
+		goto clean
+	}
+	unmounted = true
+	// the lease is renewed as long as the volume may be written to
+	d.stopRenewing(req.TargetPath)
+	if err = d.stopVolumeBackend(req.TargetPath); err != nil {
+		goto clean
+	}
+	if pub.LeaseTTL > 0 && !pub.Readonly {
+		if e := d.releaseLease(ctx, pub); e != nil {
+			// the lease expires anyway
+			logFrom(ctx).Warn("failed to release lease", "err", e)
+		}
+	}
+	if pub.Ephemeral {
+		if err = d.removeEphemeral(ctx, pub); err != nil {
+			goto clean
+		}
+	} else if dropCache {
+		if err = d.removeCache(pub.Remote); err != nil {
+			goto clean
+		}
+	}
+	_, err = d.publications.remove(req.TargetPath)
+clean:
+	if err != nil && pub != nil && !unmounted {
+		// still published, the next attempt stops them again
+		d.startChecking(pub)
+		if paused {
+			if e := d.pauseUploads(context.Background(), pub); e != nil {
+				logFrom(ctx).Warn("failed to pause uploads again", "err", e)
+			}
+		}
+	}
+	logFrom(ctx).Debug("unpublish volume", "err", err)
 	return &csi.NodeUnpublishVolumeResponse{}, err
 }
 
 func (d *driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	cl := []csi.NodeServiceCapability_RPC_Type{}
+	cl := []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+	}
 	var caps []*csi.NodeServiceCapability
 	for _, c := range cl {
 		caps = append(caps, &csi.NodeServiceCapability{
@@ -99,8 +332,12 @@ func (d *driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 	return &csi.NodeGetCapabilitiesResponse{Capabilities: caps}, nil
 }
 
-func (d *driver) NodeGetVolumeStats(ctx context.Context, in *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, fmt.Errorf("unsupported")
+func (d *driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	pub := d.publications.get(req.VolumePath)
+	if pub == nil || pub.VolumeID != req.VolumeId {
+		return nil, status.Errorf(codes.NotFound, "volume %s is not published to %s", req.VolumeId, req.VolumePath)
+	}
+	return d.volumeStats(ctx, pub), nil
 }
 
 // NodeExpandVolume is only implemented so the driver can be used for e2e testing.
@@ -0,0 +1,407 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeBackend answers every rc call with an empty object, or with the
+// error of the method in errs.
+type fakeBackend struct {
+	mu    sync.Mutex
+	calls []string
+	errs  map[string]string
+}
+
+func (b *fakeBackend) Call(ctx context.Context, method string, in []byte) ([]byte, int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, method)
+	if msg, ok := b.errs[method]; ok {
+		out, err := json.Marshal(map[string]any{"error": msg, "path": method, "status": 500})
+		return out, 500, err
+	}
+	return []byte("{}"), 200, nil
+}
+
+func (b *fakeBackend) Ready() error { return nil }
+
+func (b *fakeBackend) Stop() error { return nil }
+
+func (b *fakeBackend) called(method string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Contains(b.calls, method)
+}
+
+// fakeMounter records what it mounts, and fails mounts with err.
+type fakeMounter struct {
+	mu      sync.Mutex
+	mounted map[string]*publication
+	err     error
+	// unmountErr fails Unmount, notReady Ready
+	unmountErr, notReady error
+}
+
+func (m *fakeMounter) Mount(ctx context.Context, pub *publication, vfsOpt, mountOpt map[string]any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.mounted[pub.TargetPath] = pub
+	return nil
+}
+
+func (m *fakeMounter) Unmount(ctx context.Context, pub *publication) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.unmountErr != nil {
+		return m.unmountErr
+	}
+	delete(m.mounted, pub.TargetPath)
+	return nil
+}
+
+func (m *fakeMounter) Ready() error {
+	return m.notReady
+}
+
+func (m *fakeMounter) IsMounted(pub *publication) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.mounted[pub.TargetPath]
+	return ok, nil
+}
+
+func (m *fakeMounter) Stats(ctx context.Context, pub *publication) ([]*csi.VolumeUsage, error) {
+	return nil, nil
+}
+
+// newTestDriver returns a node driver which mounts with fake mounters, and
+// calls the fake backend instead of rclone.
+func newTestDriver(t *testing.T) (*driver, *fakeBackend, map[string]*fakeMounter) {
+	t.Helper()
+	dir := t.TempDir()
+	pubs, err := loadPublications(filepath.Join(dir, "publications.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBackend{}
+	d := &driver{
+		config: Config{
+			Mode:           ModeNode,
+			NodeID:         "node",
+			DefaultMounter: mounterFUSE,
+			InlineBackends: DefaultInlineBackends,
+			StateDir:       filepath.Join(dir, "state"),
+			CacheDir:       filepath.Join(dir, "cache"),
+		},
+		backend:      b,
+		publications: pubs,
+		renewers:     newTasks(),
+		prewarms:     newTasks(),
+		pauses:       newTasks(),
+		syncs:        newTasks(),
+		checks:       newTasks(),
+		conditions: conditions{
+			byTarget: make(map[string]*csi.VolumeCondition),
+		},
+		volumeBackends: volumeBackends{
+			byTarget: make(map[string]rcBackend),
+		},
+		mounters: make(map[string]mounter),
+	}
+	fakes := make(map[string]*fakeMounter)
+	for _, name := range []string{mounterFUSE, mounterNFS} {
+		fakes[name] = &fakeMounter{mounted: make(map[string]*publication)}
+		d.mounters[name] = fakes[name]
+	}
+	return d, b, fakes
+}
+
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func TestNodePublishVolume(t *testing.T) {
+	tests := []struct {
+		name          string
+		volumeContext map[string]string
+		readonly      bool
+		mountErr      error
+		code          codes.Code
+		mounter       string
+	}{
+		{"default mounter", map[string]string{"path": "/data"}, false, nil, codes.OK, mounterFUSE},
+		{"selected mounter", map[string]string{mounterKey: mounterNFS}, false, nil, codes.OK, mounterNFS},
+		{"read-only", nil, true, nil, codes.OK, mounterFUSE},
+		{"unknown mounter", map[string]string{mounterKey: "smb"}, false, nil, codes.InvalidArgument, ""},
+		{"copy options", map[string]string{syncBackKey: "sync"}, false, nil, codes.InvalidArgument, ""},
+		{"failed mount", nil, false, status.Error(codes.Internal, "mount failed"), codes.Internal, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _, fakes := newTestDriver(t)
+			fakes[mounterFUSE].err = tt.mountErr
+			target := filepath.Join(t.TempDir(), "target")
+			_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:         "vol",
+				TargetPath:       target,
+				Readonly:         tt.readonly,
+				VolumeContext:    tt.volumeContext,
+				VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			})
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("got %v, want %v", err, tt.code)
+			}
+			pub := d.publications.get(target)
+			if tt.mounter == "" {
+				if pub != nil {
+					t.Errorf("failed publication is recorded: %+v", pub)
+				}
+				for name, m := range fakes {
+					if len(m.mounted) > 0 {
+						t.Errorf("%s mounted %v", name, m.mounted)
+					}
+				}
+				return
+			}
+			if pub == nil {
+				t.Fatal("publication is not recorded")
+			}
+			if fakes[tt.mounter].mounted[target] != pub {
+				t.Errorf("not mounted by %s", tt.mounter)
+			}
+			if pub.Readonly != tt.readonly {
+				t.Errorf("got readonly %v, want %v", pub.Readonly, tt.readonly)
+			}
+		})
+	}
+}
+
+func TestNodePublishVolumeRemovesInlineRemote(t *testing.T) {
+	d, b, fakes := newTestDriver(t)
+	fakes[mounterFUSE].err = errors.New("mount failed")
+	_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "vol",
+		TargetPath:       filepath.Join(t.TempDir(), "target"),
+		VolumeContext:    map[string]string{ephemeralKey: "true", "parameters": `{"type":"s3"}`},
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+	if err == nil {
+		t.Fatal("publish succeeded")
+	}
+	if !b.called("config/delete") {
+		t.Error("the remote of the inline volume is left behind")
+	}
+}
+
+func TestMounterNotReady(t *testing.T) {
+	d, b, fakes := newTestDriver(t)
+	ctx := context.Background()
+	fakes[mounterNFS].notReady = errors.New("no nfs")
+	if _, err := d.Probe(ctx, &csi.ProbeRequest{}); err != nil {
+		t.Errorf("probe with a ready default mounter failed: %v", err)
+	}
+	_, err := d.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         "vol",
+		TargetPath:       filepath.Join(t.TempDir(), "target"),
+		VolumeContext:    map[string]string{mounterKey: mounterNFS},
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v, want %v", err, codes.FailedPrecondition)
+	}
+	if b.called("config/create") {
+		t.Error("the remote is created for a mounter which is not ready")
+	}
+
+	d.config.DefaultMounter = mounterNFS
+	if _, err := d.Probe(ctx, &csi.ProbeRequest{}); err == nil {
+		t.Error("probe succeeded with a default mounter which is not ready")
+	}
+}
+
+func TestNodePublishVolumeInlineBackends(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters string
+		secrets    map[string]string
+		code       codes.Code
+	}{
+		{"storage service", `{"type":"s3"}`, nil, codes.OK},
+		{"local", `{"type":"local"}`, nil, codes.InvalidArgument},
+		{"wrapping", `{"type":"alias","remote":"other:"}`, nil, codes.InvalidArgument},
+		{"type from secrets", `{"type":"s3"}`, map[string]string{"type": "crypt"}, codes.InvalidArgument},
+		{"no type", `{}`, nil, codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, b, _ := newTestDriver(t)
+			_, err := d.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:         "vol",
+				TargetPath:       filepath.Join(t.TempDir(), "target"),
+				VolumeContext:    map[string]string{ephemeralKey: "true", "parameters": tt.parameters},
+				Secrets:          tt.secrets,
+				VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			})
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("got %v, want %v", err, tt.code)
+			}
+			if tt.code != codes.OK && b.called("config/create") {
+				t.Error("the remote of a refused inline volume is created")
+			}
+		})
+	}
+}
+
+func TestNodeUnpublishVolume(t *testing.T) {
+	d, _, fakes := newTestDriver(t)
+	ctx := context.Background()
+	targets := []string{filepath.Join(t.TempDir(), "a"), filepath.Join(t.TempDir(), "b")}
+	for _, target := range targets {
+		_, err := d.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:         "vol",
+			TargetPath:       target,
+			VolumeContext:    map[string]string{mounterKey: mounterNFS},
+			VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: targets[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if d.publications.get(targets[0]) != nil {
+		t.Error("unpublished publication is still recorded")
+	}
+	if _, ok := fakes[mounterNFS].mounted[targets[0]]; ok {
+		t.Error("unpublished target is still mounted")
+	}
+	if _, ok := fakes[mounterNFS].mounted[targets[1]]; !ok {
+		t.Error("the other target is unmounted")
+	}
+
+	// unknown targets are unmounted as FUSE mounts
+	unknown := filepath.Join(t.TempDir(), "unknown")
+	fakes[mounterFUSE].mounted[unknown] = &publication{TargetPath: unknown}
+	if _, err := d.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: unknown}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fakes[mounterFUSE].mounted) > 0 {
+		t.Error("unknown target is still mounted")
+	}
+}
+
+func TestNodeUnpublishVolumeFailed(t *testing.T) {
+	d, _, fakes := newTestDriver(t)
+	d.config.HealthInterval = time.Hour
+	ctx := context.Background()
+	target := filepath.Join(t.TempDir(), "target")
+	_, err := d.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:         "vol",
+		TargetPath:       target,
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stands in for the renewer of a leased volume
+	d.renewers.start(target, func(ctx context.Context) { <-ctx.Done() })
+
+	fakes[mounterFUSE].unmountErr = status.Error(codes.Internal, "target is busy")
+	if _, err := d.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "vol", TargetPath: target}); err == nil {
+		t.Fatal("unpublish succeeded")
+	}
+	if d.publications.get(target) == nil {
+		t.Error("the publication is forgotten")
+	}
+	if !d.renewers.stop(target) {
+		t.Error("the lease of the mounted volume is not renewed anymore")
+	}
+	if !d.checks.stop(target) {
+		t.Error("the health of the mounted volume is not checked anymore")
+	}
+}
+
+func TestNodePublishVolumeRetried(t *testing.T) {
+	d, _, fakes := newTestDriver(t)
+	ctx := context.Background()
+	target := filepath.Join(t.TempDir(), "target")
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:         "vol",
+		TargetPath:       target,
+		VolumeCapability: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	}
+	if _, err := d.NodePublishVolume(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	pub := d.publications.get(target)
+
+	// failures of retries leave the publication alone
+	fakes[mounterFUSE].err = errors.New("mount failed")
+	if _, err := d.NodePublishVolume(ctx, req); err != nil {
+		t.Errorf("retry of a mounted publication failed: %v", err)
+	}
+	other := &csi.NodePublishVolumeRequest{
+		VolumeId:         "vol",
+		TargetPath:       target,
+		Readonly:         true,
+		VolumeCapability: req.VolumeCapability,
+	}
+	if _, err := d.NodePublishVolume(ctx, other); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("got %v, want %v", err, codes.AlreadyExists)
+	}
+	if d.publications.get(target) != pub || fakes[mounterFUSE].mounted[target] != pub {
+		t.Error("the publication is changed by retries")
+	}
+
+	// retries mount publications which lost their mount again
+	delete(fakes[mounterFUSE].mounted, target)
+	fakes[mounterFUSE].err = nil
+	if _, err := d.NodePublishVolume(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if fakes[mounterFUSE].mounted[target] != pub {
+		t.Error("the publication is not mounted again")
+	}
+}
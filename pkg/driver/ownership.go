@@ -0,0 +1,92 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// Volume context keys of file ownership and permissions, perms and umask
+// are octal.
+const (
+	uidKey       = "uid"
+	gidKey       = "gid"
+	umaskKey     = "umask"
+	dirPermsKey  = "dirPerms"
+	filePermsKey = "filePerms"
+)
+
+// mountGroupUmask makes files group writable for the volume mount group.
+const mountGroupUmask = 0o002
+
+// ownershipOptions translates the ownership parameters of volumeContext and
+// the volume mount group of capability into rclone options. Ownership only
+// matters to other users than root, so it also enables allow_other.
+func ownershipOptions(volumeContext map[string]string, capability *csi.VolumeCapability, vfsOpt, mountOpt map[string]any) error {
+	set := false
+	for _, o := range []struct {
+		key  string
+		opt  string
+		base int
+		bits int
+	}{
+		{uidKey, "UID", 10, 32},
+		{gidKey, "GID", 10, 32},
+		{umaskKey, "Umask", 8, 12},
+		{dirPermsKey, "DirPerms", 8, 12},
+		{filePermsKey, "FilePerms", 8, 12},
+	} {
+		v, ok := volumeContext[o.key]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseUint(v, o.base, o.bits)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", o.key, v, err)
+		}
+		vfsOpt[o.opt] = n
+		set = true
+	}
+
+	if group := capability.GetMount().GetVolumeMountGroup(); group != "" {
+		gid, err := strconv.ParseUint(group, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid volume mount group %q: %w", group, err)
+		}
+		vfsOpt["GID"] = gid
+		if _, ok := volumeContext[umaskKey]; !ok {
+			vfsOpt["Umask"] = mountGroupUmask
+		}
+		set = true
+	}
+
+	if set {
+		mountOpt["AllowOther"] = true
+	}
+	return nil
+}
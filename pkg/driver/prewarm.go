@@ -0,0 +1,261 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Volume context keys of cache pre-warming. prewarm is a comma separated
+// list of paths or glob patterns relative to the volume, prewarmTimeout
+// blocks the publication until warm-up completes or the timeout expires.
+const (
+	prewarmKey        = "prewarm"
+	prewarmTimeoutKey = "prewarmTimeout"
+)
+
+const prewarmConcurrency = 4
+
+// prewarmVars exposes the warm-up progress of publications, by target path.
+var prewarmVars = expvar.NewMap("prewarm")
+
+// prewarmOptions parses the pre-warming parameters of volumeContext.
+func prewarmOptions(volumeContext map[string]string) (patterns []string, timeout time.Duration, err error) {
+	for _, p := range strings.Split(volumeContext[prewarmKey], ",") {
+		p = strings.Trim(strings.TrimSpace(p), "/")
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, 0, fmt.Errorf("invalid %s pattern %q: %w", prewarmKey, p, err)
+		}
+		p = path.Clean(p)
+		if p == ".." || strings.HasPrefix(p, "../") {
+			return nil, 0, fmt.Errorf("invalid %s pattern %q", prewarmKey, p)
+		}
+		patterns = append(patterns, p)
+	}
+	if v, ok := volumeContext[prewarmTimeoutKey]; ok {
+		if timeout, err = time.ParseDuration(v); err != nil {
+			return nil, 0, fmt.Errorf("invalid %s %q: %w", prewarmTimeoutKey, v, err)
+		}
+	}
+	return patterns, timeout, nil
+}
+
+// fullCache tells if the VFS caches file data read through the mount.
+func fullCache(vfsOpt map[string]any) bool {
+	v := fmt.Sprint(vfsOpt["CacheMode"])
+	return strings.EqualFold(v, "full") || v == "3"
+}
+
+// startPrewarm warms up the cache of pub in the background, and waits for
+// it at most timeout.
+func (d *driver) startPrewarm(ctx context.Context, pub *publication, patterns []string, timeout time.Duration, readData bool) {
+	done := make(chan struct{})
+	d.prewarms.start(pub.TargetPath, func(ctx context.Context) {
+		defer close(done)
+		d.prewarm(ctx, pub, patterns, readData)
+	})
+	if timeout <= 0 {
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logFrom(ctx).Warn("cache warm-up still running, not waiting for it anymore", "timeout", timeout)
+	case <-ctx.Done():
+	}
+}
+
+func (d *driver) stopPrewarm(target string) {
+	d.prewarms.stop(target)
+	prewarmVars.Delete(target)
+}
+
+// prewarm refreshes the directory metadata of patterns, and reads the
+// matched files through the mount, so that they land in the VFS cache.
+func (d *driver) prewarm(ctx context.Context, pub *publication, patterns []string, readData bool) {
+	l := slog.Default().With("volume_id", pub.VolumeID, "target_path", pub.TargetPath)
+	stats := new(expvar.Map).Init()
+	state := new(expvar.String)
+	state.Set("running")
+	stats.Set("volume_id", expvarString(pub.VolumeID))
+	stats.Set("state", state)
+	prewarmVars.Set(pub.TargetPath, stats)
+
+	start := time.Now()
+	l.Info("cache warm-up started", "patterns", patterns, "read_data", readData)
+	// without vfs/refresh, the walk lists the directories through the mount
+	walk := readData
+	for _, p := range patterns {
+		dir := staticPrefix(p)
+		_, err := d.rcVFS(ctx, pub, "vfs/refresh", dir, map[string]any{"recursive": "true"})
+		switch {
+		case err == nil:
+		case status.Code(err) == codes.FailedPrecondition:
+			if !walk {
+				l.Info("can not refresh directory cache, listing the directories through the mount instead", "err", err)
+				walk = true
+			}
+		default:
+			// patterns may name files, which have no directory cache
+			l.Debug("failed to refresh directory cache", "dir", dir, "err", err)
+		}
+	}
+
+	files := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < prewarmConcurrency && readData; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				n, err := readFile(ctx, f)
+				stats.Add("bytes", n)
+				if err != nil {
+					stats.Add("errors", 1)
+					l.Warn("failed to warm up file", "file", f, "err", err)
+					continue
+				}
+				stats.Add("files", 1)
+			}
+		}()
+	}
+	var err error
+	if walk {
+		if !readData {
+			files = nil
+		}
+		err = walkPatterns(ctx, pub.TargetPath, patterns, files)
+	}
+	if files != nil {
+		close(files)
+	}
+	wg.Wait()
+
+	switch {
+	case ctx.Err() != nil:
+		state.Set("canceled")
+	case err != nil:
+		state.Set("failed")
+		l.Error("cache warm-up failed", "err", err)
+		return
+	default:
+		state.Set("done")
+	}
+	l.Info("cache warm-up finished", "state", state.Value(), "files", stats.Get("files"), "bytes", stats.Get("bytes"), "duration", time.Since(start))
+}
+
+// walkPatterns sends the files matched by patterns below root to files,
+// matched directories are walked recursively. With nil files, the walk
+// only lists the directories.
+func walkPatterns(ctx context.Context, root string, patterns []string, files chan<- string) error {
+	for _, p := range patterns {
+		matches, err := filepath.Glob(filepath.Join(root, filepath.FromSlash(p)))
+		if err != nil {
+			return err
+		}
+		for _, m := range matches {
+			err := filepath.WalkDir(m, func(f string, e fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if files == nil || !e.Type().IsRegular() {
+					return nil
+				}
+				select {
+				case files <- f:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if err != nil && !errors.Is(err, context.Canceled) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readFile(ctx context.Context, name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(io.Discard, ctxReader{ctx, f})
+}
+
+// ctxReader stops reading once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// staticPrefix returns the leading elements of pattern without glob
+// characters, "" for the root of the volume.
+func staticPrefix(pattern string) string {
+	elems := strings.Split(pattern, "/")
+	for i, e := range elems {
+		if strings.ContainsAny(e, `*?[\`) {
+			elems = elems[:i]
+			break
+		}
+	}
+	if p := strings.Join(elems, "/"); p != "." {
+		return p
+	}
+	return ""
+}
+
+type expvarString string
+
+func (s expvarString) String() string {
+	return fmt.Sprintf("%q", string(s))
+}
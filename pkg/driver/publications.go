@@ -0,0 +1,204 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// publication is a volume published by the node to a target path.
+type publication struct {
+	VolumeID   string                               `json:"volumeId"`
+	TargetPath string                               `json:"targetPath"`
+	Readonly   bool                                 `json:"readonly"`
+	AccessMode csi.VolumeCapability_AccessMode_Mode `json:"accessMode"`
+	Remote     string                               `json:"remote"`
+	RemotePath string                               `json:"remotePath"`
+	LeaseTTL   time.Duration                        `json:"leaseTTL,omitempty"`
+	Ephemeral  bool                                 `json:"ephemeral,omitempty"`
+	// CacheMaxSize is the VFS cache budget of the publication, 0 if unbounded
+	CacheMaxSize int64 `json:"cacheMaxSize,omitempty"`
+	KeepCache    bool  `json:"keepCache,omitempty"`
+	// Limits are the rcd flags of the volume, which gets its own rcd if set
+	Limits []string `json:"limits,omitempty"`
+	// Mounter is the way the volume is mounted, FUSE if empty
+	Mounter string `json:"mounter,omitempty"`
+	// Serve are the arguments of the rclone serve of the volume, if any
+	Serve []string `json:"serve,omitempty"`
+	// Copy is set for volumes copied into a local directory
+	Copy *copyOptions `json:"copy,omitempty"`
+	// Remount is set for volumes remounted when unhealthy, with the
+	// options they were published with
+	Remount  bool           `json:"remount,omitempty"`
+	VfsOpt   map[string]any `json:"vfsOpt,omitempty"`
+	MountOpt map[string]any `json:"mountOpt,omitempty"`
+}
+
+// id identifies the publication in file names.
+func (pub *publication) id() string {
+	sum := sha256.Sum256([]byte(pub.TargetPath))
+	return hex.EncodeToString(sum[:8])
+}
+
+// publications tracks what the node has published. It is persisted in the
+// state directory, so that it survives restarts of the driver.
+type publications struct {
+	path string
+
+	mu       sync.Mutex
+	byTarget map[string]*publication
+}
+
+func loadPublications(path string) (*publications, error) {
+	p := &publications{
+		path:     path,
+		byTarget: make(map[string]*publication),
+	}
+	pubs := []*publication{}
+	if err := readJSONFile(path, &pubs); err != nil {
+		return nil, err
+	}
+	for _, pub := range pubs {
+		p.byTarget[pub.TargetPath] = pub
+	}
+	return p, nil
+}
+
+// add records pub, unless one of checks rejects it given the other
+// publications of the node.
+func (p *publications) add(pub *publication, checks ...func(others []*publication) error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	others := []*publication{}
+	for _, o := range p.byTarget {
+		if o.TargetPath != pub.TargetPath {
+			others = append(others, o)
+		}
+	}
+	for _, check := range checks {
+		if err := check(others); err != nil {
+			return err
+		}
+	}
+	p.byTarget[pub.TargetPath] = pub
+	return p.save()
+}
+
+// update changes the publication of target with f, and persists it.
+func (p *publications) update(target string, f func(pub *publication)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pub, ok := p.byTarget[target]
+	if !ok {
+		return nil
+	}
+	f(pub)
+	return p.save()
+}
+
+// shared tells whether other publications use the remote of pub.
+func (p *publications) shared(pub *publication) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, o := range p.byTarget {
+		if o.TargetPath != pub.TargetPath && o.Remote == pub.Remote {
+			return true
+		}
+	}
+	return false
+}
+
+// remove forgets the publication of target, and returns it if any.
+func (p *publications) remove(target string) (*publication, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pub, ok := p.byTarget[target]
+	if !ok {
+		return nil, nil
+	}
+	delete(p.byTarget, target)
+	return pub, p.save()
+}
+
+func (p *publications) get(target string) *publication {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.byTarget[target]
+}
+
+// list returns all publications, sorted by target path.
+func (p *publications) list() []*publication {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pubs := make([]*publication, 0, len(p.byTarget))
+	for _, pub := range p.byTarget {
+		pubs = append(pubs, pub)
+	}
+	sort.Slice(pubs, func(i, j int) bool {
+		return pubs[i].TargetPath < pubs[j].TargetPath
+	})
+	return pubs
+}
+
+// save persists the publications, must be called with mu held.
+func (p *publications) save() error {
+	pubs := make([]*publication, 0, len(p.byTarget))
+	for _, pub := range p.byTarget {
+		pubs = append(pubs, pub)
+	}
+	return writeJSONFile(p.path, pubs)
+}
+
+// singleWriter refuses pub if it is a second writable publication on the
+// node of a volume accessed by a single writer.
+func singleWriter(pub *publication) func(others []*publication) error {
+	return func(others []*publication) error {
+		if pub.Readonly {
+			return nil
+		}
+		for _, o := range others {
+			if o.VolumeID != pub.VolumeID || o.Readonly {
+				continue
+			}
+			if pub.AccessMode == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER || o.AccessMode == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER {
+				return status.Errorf(codes.FailedPrecondition, "volume %s is already published writable to %s", pub.VolumeID, o.TargetPath)
+			}
+		}
+		return nil
+	}
+}
+
+// readerOnly tells whether mode forbids writes.
+func readerOnly(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY || mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
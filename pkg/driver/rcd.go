@@ -0,0 +1,264 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	rcdMinBackoff = time.Second
+	rcdMaxBackoff = time.Minute
+)
+
+// rcdSupervisor runs a rclone rcd process and restarts it when it exits
+// unexpectedly.
+type rcdSupervisor struct {
+	args []string
+	log  *slog.Logger
+	// prepare, if set, runs before every start of rcd
+	prepare func() error
+	// pidfile, if set, records the pid of rcd, so that an rcd left behind
+	// by a previous run of the driver is stopped before the first start
+	pidfile string
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	running  bool
+	lastErr  error
+	restarts int
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newRcdSupervisor(l *slog.Logger, args []string) *rcdSupervisor {
+	return &rcdSupervisor{
+		args: args,
+		log:  l.With("component", "rcd"),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Start launches rcd, an error is only returned if the first start fails.
+func (s *rcdSupervisor) Start() error {
+	if s.pidfile != "" {
+		if err := stopOrphan(s.log, s.pidfile, s.args); err != nil {
+			return err
+		}
+	}
+	if err := s.start(); err != nil {
+		return err
+	}
+	go s.supervise()
+	return nil
+}
+
+func (s *rcdSupervisor) start() error {
+	if s.prepare != nil {
+		if err := s.prepare(); err != nil {
+			return err
+		}
+	}
+	cmd := exec.Command("rclone", s.args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	go relayRcdLog(stdout, s.log)
+	go relayRcdLog(stderr, s.log)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if s.pidfile != "" {
+		if err := os.WriteFile(s.pidfile, []byte(strconv.Itoa(cmd.Process.Pid)), 0600); err != nil {
+			s.log.Warn("failed to record the pid of rcd", "err", err)
+		}
+	}
+	s.mu.Lock()
+	s.cmd = cmd
+	s.running = true
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *rcdSupervisor) supervise() {
+	defer close(s.done)
+	backoff := rcdMinBackoff
+	for {
+		s.mu.Lock()
+		cmd := s.cmd
+		s.mu.Unlock()
+
+		started := time.Now()
+		err := cmd.Wait()
+
+		s.mu.Lock()
+		s.running = false
+		s.lastErr = err
+		if err == nil {
+			s.lastErr = errors.New("rcd exited")
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.stop:
+			s.log.Info("rcd stopped", "err", err)
+			if s.pidfile != "" {
+				os.Remove(s.pidfile)
+			}
+			return
+		default:
+		}
+
+		// a process that ran for a while gets a fresh backoff
+		if time.Since(started) > rcdMaxBackoff {
+			backoff = rcdMinBackoff
+		}
+		for {
+			s.log.Error("rcd exited unexpectedly, restarting", "err", s.lastErr, "backoff", backoff)
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, rcdMaxBackoff)
+			if err := s.start(); err != nil {
+				s.mu.Lock()
+				s.lastErr = err
+				s.mu.Unlock()
+				continue
+			}
+			s.mu.Lock()
+			s.restarts++
+			s.mu.Unlock()
+			break
+		}
+	}
+}
+
+// State reports whether rcd is running and the reason of the last exit.
+func (s *rcdSupervisor) State() (running bool, lastErr error, restarts int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running, s.lastErr, s.restarts
+}
+
+// Stop asks rcd to exit through quit, and kills it after timeout.
+func (s *rcdSupervisor) Stop(quit func() error, timeout time.Duration) error {
+	close(s.stop)
+
+	var err error
+	// buffered, quit may return after the timeout
+	ch := make(chan error, 1)
+	go func() {
+		ch <- quit()
+	}()
+	select {
+	case err = <-ch:
+	case <-time.After(timeout):
+	}
+	select {
+	case <-s.done:
+	case <-time.After(timeout):
+		s.mu.Lock()
+		cmd := s.cmd
+		s.mu.Unlock()
+		s.log.Info("killing rcd", "err", cmd.Process.Kill())
+		<-s.done
+	}
+	return err
+}
+
+// orphanStopTimeout is how long an rcd left behind gets to exit on SIGTERM.
+const orphanStopTimeout = 5 * time.Second
+
+// stopOrphan stops the rclone recorded in pidfile, if it still runs with the
+// rc address of args: the rcd of a previous run of the driver, which would
+// otherwise keep running out of reach, as its socket is replaced.
+func stopOrphan(l *slog.Logger, pidfile string, args []string) error {
+	b, err := os.ReadFile(pidfile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || !alive(pid) {
+		return nil
+	}
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	// the pid may be reused by another process
+	if err != nil || rcAddr(strings.Split(string(cmdline), "\x00")) != rcAddr(args) {
+		return nil
+	}
+	l.Warn("stopping rcd of a previous run", "pid", pid)
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL} {
+		if err := syscall.Kill(pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+		for deadline := time.Now().Add(orphanStopTimeout); time.Now().Before(deadline); {
+			if !alive(pid) {
+				return nil
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return fmt.Errorf("rcd of a previous run, pid %d, does not exit", pid)
+}
+
+// alive tells whether the process pid runs, zombies do not.
+func alive(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// the state follows the command name, which may contain spaces
+	i := bytes.LastIndexByte(stat, ')')
+	return i >= 0 && i+2 < len(stat) && stat[i+2] != 'Z'
+}
+
+// rcAddr returns the rc address of the rclone arguments args.
+func rcAddr(args []string) string {
+	for i, a := range args {
+		if a == "--rc-addr" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
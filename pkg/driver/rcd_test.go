@@ -0,0 +1,64 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestStopOrphan(t *testing.T) {
+	// stands in for an rcd of a previous run
+	cmd := exec.Command("sh", "-c", "while :; do sleep 0.1; done", "sh", "--rc-addr", "unix:///vol.sock")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	go cmd.Wait()
+	defer cmd.Process.Kill()
+	pidfile := filepath.Join(t.TempDir(), "vol.pid")
+	if err := os.WriteFile(pidfile, []byte(strconv.Itoa(cmd.Process.Pid)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stopOrphan(slog.Default(), pidfile, []string{"rcd", "--rc-addr", "unix:///other.sock"}); err != nil {
+		t.Fatal(err)
+	}
+	if !alive(cmd.Process.Pid) {
+		t.Fatal("a process of another rc address is stopped")
+	}
+	if err := stopOrphan(slog.Default(), pidfile, []string{"rcd", "--rc-addr", "unix:///vol.sock"}); err != nil {
+		t.Fatal(err)
+	}
+	if alive(cmd.Process.Pid) {
+		t.Error("the process of the rc address still runs")
+	}
+	if err := stopOrphan(slog.Default(), filepath.Join(t.TempDir(), "none.pid"), nil); err != nil {
+		t.Errorf("missing pidfile: %v", err)
+	}
+}
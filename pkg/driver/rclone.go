@@ -0,0 +1,171 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"golang.org/x/net/context"
+)
+
+// minRcloneVersion is the oldest rclone supporting everything the driver
+// calls: `config/create` with `opt`, `mount/mount` with `vfsOpt` and
+// `mountOpt`, and rc listening on unix sockets.
+var minRcloneVersion = [3]int{1, 61, 0}
+
+// required rc methods, the driver refuses to start without them.
+var (
+	controllerMethods = []string{"config/create", "config/listremotes", "operations/about"}
+	nodeMethods       = []string{"config/create", "mount/mount", "mount/unmount", "mount/unmountall"}
+)
+
+const rcloneStartTimeout = 30 * time.Second
+
+// rcloneInfo describes the rclone serving rc calls.
+type rcloneInfo struct {
+	Version   string
+	GoVersion string
+	version   [3]int
+	methods   map[string]bool
+}
+
+// has tells if rclone supports all of the rc methods.
+func (i *rcloneInfo) has(methods ...string) bool {
+	for _, m := range methods {
+		if !i.methods[m] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRclone waits for the backend to answer, and verifies that the rclone
+// version and rc methods are compatible with the configured mode.
+func (d *driver) checkRclone(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, rcloneStartTimeout)
+	defer cancel()
+
+	var v gjson.Result
+	var err error
+	for {
+		if v, err = d.coreVersion(ctx); err == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("rclone did not start: %w", err)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+
+	info := &rcloneInfo{
+		Version:   v.Get("version").String(),
+		GoVersion: v.Get("goVersion").String(),
+		methods:   make(map[string]bool),
+	}
+	l, err := d.rc(ctx, "rc/list", nil)
+	if err != nil {
+		return err
+	}
+	for _, c := range l.Get("commands").Array() {
+		info.methods[c.Get("Path").String()] = true
+	}
+
+	var ver [3]int
+	for i, n := range v.Get("decomposed").Array() {
+		if i < len(ver) {
+			ver[i] = int(n.Int())
+		}
+	}
+	if ver == [3]int{} {
+		ver = parseVersion(info.Version)
+	}
+	info.version = ver
+	if !versionAtLeast(ver, minRcloneVersion) {
+		return fmt.Errorf("rclone %s is too old, at least v%d.%d.%d is required", info.Version, minRcloneVersion[0], minRcloneVersion[1], minRcloneVersion[2])
+	}
+
+	required := []string{}
+	if d.isController() {
+		required = append(required, controllerMethods...)
+	}
+	if d.isNode() {
+		required = append(required, nodeMethods...)
+	}
+	missing := []string{}
+	for _, m := range required {
+		if !info.has(m) {
+			missing = append(missing, m)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("rclone %s does not support the rc methods %s", info.Version, strings.Join(missing, ", "))
+	}
+
+	slog.Info("detected rclone", "version", info.Version, "go_version", info.GoVersion)
+	d.rclone = info
+	return nil
+}
+
+// feature reports whether the rc methods of an optional feature are
+// supported, and logs it as disabled otherwise.
+func (d *driver) feature(name string, methods ...string) bool {
+	if d.rclone.has(methods...) {
+		return true
+	}
+	slog.Warn("feature disabled, rclone is missing rc methods", "feature", name, "version", d.rclone.Version, "methods", methods)
+	return false
+}
+
+// atLeast tells if rclone is at least version v.
+func (i *rcloneInfo) atLeast(v [3]int) bool {
+	return versionAtLeast(i.version, v)
+}
+
+// parseVersion parses versions like "v1.65.2" or "v1.66.0-beta.7500.abc".
+func parseVersion(s string) (v [3]int) {
+	s = strings.TrimPrefix(s, "v")
+	if i := strings.IndexAny(s, "-+ "); i >= 0 {
+		s = s[:i]
+	}
+	for i, p := range strings.SplitN(s, ".", 3) {
+		v[i], _ = strconv.Atoi(p)
+	}
+	return v
+}
+
+func versionAtLeast(v, min [3]int) bool {
+	for i := range v {
+		if v[i] != min[i] {
+			return v[i] > min[i]
+		}
+	}
+	return true
+}
@@ -0,0 +1,304 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+// minServeNFSVersion is the first rclone with serve nfs.
+var minServeNFSVersion = [3]int{1, 65, 0}
+
+// servePortAttempts is how many ports rclone serve gets to listen on.
+const servePortAttempts = 3
+
+// davUser is the user of the WebDAV servers of volumes.
+const davUser = "csi-rclone"
+
+// servedMounter serves volumes with rclone serve on loopback, in their own
+// rclone process, and mounts them with a client of the kernel: NFS needs
+// neither FUSE nor /dev/fuse, WebDAV needs davfs2.
+type servedMounter struct {
+	d *driver
+	// protocol is the one of rclone serve, nfs or webdav
+	protocol string
+}
+
+func (m servedMounter) Mount(ctx context.Context, pub *publication, vfsOpt, mountOpt map[string]any) error {
+	if embeddedRclone {
+		return fmt.Errorf("%s volumes are not supported with embedded rclone", m.protocol)
+	}
+	// NFS and WebDAV clients write at random offsets, which needs the full
+	// cache
+	if _, ok := vfsOpt["CacheMode"]; !ok {
+		vfsOpt["CacheMode"] = "full"
+	}
+	flags, err := vfsFlags(vfsOpt)
+	if err != nil {
+		return err
+	}
+	// a previous mount would be left to a stopped server, on which NFS
+	// clients hang
+	if err := m.Unmount(ctx, pub); err != nil {
+		return err
+	}
+	var auth []string
+	var pass string
+	if m.protocol == mounterWebDAV {
+		if auth, pass, err = m.davAuth(pub); err != nil {
+			return err
+		}
+	}
+	// another process may take the port before rclone listens on it
+	var port int
+	for attempt := 1; ; attempt++ {
+		if port, err = freePort(); err != nil {
+			return err
+		}
+		serve := append(append([]string{
+			"serve", m.protocol, fmt.Sprintf("%s:%s", pub.Remote, pub.RemotePath),
+			"--addr", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+		}, auth...), flags...)
+		if err := m.d.publications.update(pub.TargetPath, func(pub *publication) {
+			pub.Serve = serve
+		}); err != nil {
+			return err
+		}
+		if err = m.d.startVolumeBackend(ctx, pub); err == nil {
+			break
+		}
+		if attempt == servePortAttempts {
+			return err
+		}
+		logFrom(ctx).Warn("rclone serve failed, retrying on another port", "port", port, "err", err)
+	}
+
+	if err := os.MkdirAll(pub.TargetPath, 0755); err != nil {
+		return err
+	}
+	if m.protocol == mounterNFS {
+		err = nfsMount(pub.TargetPath, port, pub.Readonly)
+	} else {
+		err = davMount(ctx, pub.TargetPath, port, pub.Readonly, vfsOpt, m.davDir(pub), pass)
+	}
+	if err != nil {
+		return errors.Join(err, m.d.stopVolumeBackend(pub.TargetPath))
+	}
+	return nil
+}
+
+func (m servedMounter) Unmount(ctx context.Context, pub *publication) error {
+	if err := unmount(pub.TargetPath, m.d.config.HealthTimeout); err != nil {
+		return err
+	}
+	return os.RemoveAll(m.davDir(pub))
+}
+
+func (m servedMounter) IsMounted(pub *publication) (bool, error) {
+	return mounted(pub.TargetPath, m.d.config.HealthTimeout)
+}
+
+func (m servedMounter) Stats(ctx context.Context, pub *publication) ([]*csi.VolumeUsage, error) {
+	return statfsUsage(pub.TargetPath)
+}
+
+// Ready checks for rclone serve, and for davfs2 for WebDAV. The NFS client
+// of the kernel is loaded on demand.
+func (m servedMounter) Ready() error {
+	if embeddedRclone {
+		return fmt.Errorf("%s volumes are not supported with embedded rclone", m.protocol)
+	}
+	if m.protocol == mounterNFS && !m.d.rclone.atLeast(minServeNFSVersion) {
+		v := minServeNFSVersion
+		return fmt.Errorf("rclone %s can not serve nfs, v%d.%d.%d is required", m.d.rclone.Version, v[0], v[1], v[2])
+	}
+	if m.protocol != mounterWebDAV {
+		return nil
+	}
+	if _, err := exec.LookPath("mount.davfs"); err != nil {
+		return errors.New("mount.davfs of davfs2 not found in PATH")
+	}
+	return nil
+}
+
+// nfsMount mounts the NFS export of rclone on port to target. rclone only
+// serves NFSv3, without lock manager.
+func nfsMount(target string, port int, readonly bool) error {
+	var flags uintptr
+	if readonly {
+		flags |= syscall.MS_RDONLY
+	}
+	opts := fmt.Sprintf("vers=3,proto=tcp,mountproto=tcp,nolock,port=%d,mountport=%d,addr=127.0.0.1,mountaddr=127.0.0.1", port, port)
+	if err := syscall.Mount("127.0.0.1:/", target, "nfs", flags, opts); err != nil {
+		return fmt.Errorf("nfs mount %s: %w", target, err)
+	}
+	return nil
+}
+
+// davDir keeps the credentials of the WebDAV server of pub.
+func (m servedMounter) davDir(pub *publication) string {
+	return filepath.Join(m.d.config.StateDir, "volumes", pub.id()+".dav")
+}
+
+// davAuth makes a random password for the WebDAV server of pub, as other
+// processes of the node can reach loopback, and returns the flags of rclone
+// serve checking it.
+func (m servedMounter) davAuth(pub *publication) ([]string, string, error) {
+	dir := m.davDir(pub)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, "", err
+	}
+	pass := randomID() + randomID()
+	sum := sha1.Sum([]byte(pass))
+	htpasswd := filepath.Join(dir, "htpasswd")
+	if err := os.WriteFile(htpasswd, []byte(davUser+":{SHA}"+base64.StdEncoding.EncodeToString(sum[:])+"\n"), 0600); err != nil {
+		return nil, "", err
+	}
+	return []string{"--htpasswd", htpasswd}, pass, nil
+}
+
+// davMount mounts the WebDAV server of rclone on port to target, with
+// mount.davfs of davfs2, which gets pass from a secrets file in dir. Files
+// are owned by the uid and gid of vfsOpt, as davfs2 does not use the
+// ownership reported by the server.
+func davMount(ctx context.Context, target string, port int, readonly bool, vfsOpt map[string]any, dir, pass string) error {
+	url := "http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(port)) + "/"
+	secrets := filepath.Join(dir, "secrets")
+	if err := os.WriteFile(secrets, []byte(fmt.Sprintf("%s %s %s\n", url, davUser, pass)), 0600); err != nil {
+		return err
+	}
+	conf := filepath.Join(dir, "davfs2.conf")
+	if err := os.WriteFile(conf, []byte("secrets "+secrets+"\n"), 0600); err != nil {
+		return err
+	}
+	opts := []string{"rw", "conf=" + conf}
+	if readonly {
+		opts[0] = "ro"
+	}
+	for _, k := range []string{"UID", "GID"} {
+		if v, ok := vfsOpt[k]; ok {
+			opts = append(opts, fmt.Sprintf("%s=%v", strings.ToLower(k), v))
+		}
+	}
+	cmd := exec.CommandContext(ctx, "mount", "-t", "davfs", "-o", strings.Join(opts, ","), url, target)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("webdav mount %s: %w: %s", target, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// freePort returns a free TCP port on loopback. It is free when returned
+// only, see servePortAttempts.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// vfsFlags translates vfsOpt to the flags of rclone serve, which has no
+// vfsOpt parameter like mount/mount.
+func vfsFlags(vfsOpt map[string]any) ([]string, error) {
+	var flags []string
+	for k, v := range vfsOpt {
+		var flag, value string
+		switch k {
+		case "CacheMode":
+			flag, value = "--vfs-cache-mode", cacheModeName(v)
+		case "ReadOnly":
+			flag, value = "--read-only", fmt.Sprint(v)
+		case "Refresh":
+			flag, value = "--vfs-refresh", fmt.Sprint(v)
+		case "UID":
+			flag, value = "--uid", fmt.Sprint(v)
+		case "GID":
+			flag, value = "--gid", fmt.Sprint(v)
+		case "Umask", "DirPerms", "FilePerms":
+			n, ok := optInt(v)
+			if !ok {
+				return nil, fmt.Errorf("invalid vfs option %s %v", k, v)
+			}
+			flag = map[string]string{"Umask": "--umask", "DirPerms": "--dir-perms", "FilePerms": "--file-perms"}[k]
+			value = strconv.FormatInt(int64(n), 8)
+		case "DirCacheTime", "WriteBack", "CacheMaxAge", "CachePollInterval":
+			flag = map[string]string{"DirCacheTime": "--dir-cache-time", "WriteBack": "--vfs-write-back", "CacheMaxAge": "--vfs-cache-max-age", "CachePollInterval": "--vfs-cache-poll-interval"}[k]
+			if n, ok := optInt(v); ok {
+				// durations are nanoseconds in vfsOpt
+				value = time.Duration(n).String()
+			} else {
+				value = fmt.Sprint(v)
+			}
+		case "CacheMaxSize", "CacheMinFreeSpace", "ChunkSize", "ChunkSizeLimit":
+			flag = map[string]string{"CacheMaxSize": "--vfs-cache-max-size", "CacheMinFreeSpace": "--vfs-cache-min-free-space", "ChunkSize": "--vfs-read-chunk-size", "ChunkSizeLimit": "--vfs-read-chunk-size-limit"}[k]
+			if n, ok := optInt(v); ok {
+				// sizes are bytes in vfsOpt, flags default to KiB
+				value = strconv.Itoa(n) + "B"
+			} else {
+				value = fmt.Sprint(v)
+			}
+		default:
+			return nil, fmt.Errorf("vfs option %s is not supported by served volumes", k)
+		}
+		flags = append(flags, flag+"="+value)
+	}
+	sort.Strings(flags)
+	return flags, nil
+}
+
+// cacheModeName returns the name of a cache mode, which vfsOpt accepts as
+// name or number.
+func cacheModeName(v any) string {
+	if n, ok := optInt(v); ok {
+		switch n {
+		case 0:
+			return "off"
+		case 1:
+			return "minimal"
+		case 2:
+			return "writes"
+		case 3:
+			return "full"
+		}
+	}
+	return fmt.Sprint(v)
+}
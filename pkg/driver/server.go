@@ -20,12 +20,12 @@ package driver
 
 import (
 	"errors"
+	"log/slog"
 	"net"
 	"os"
 	"strings"
 	"sync"
 
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
@@ -71,7 +71,8 @@ func (s *nonBlockingGRPCServer) serve(ep string, ids csi.IdentityServer, cs csi.
 	eps := strings.SplitN(ep, "://", 2)
 	if eps[0] == "unix" {
 		if err := os.Remove(eps[1]); err != nil && !errors.Is(err, os.ErrNotExist) {
-			glog.Fatalf("Failed to remove unix socket: %v", err)
+			slog.Error("failed to remove unix socket", "err", err)
+			os.Exit(1)
 		}
 		s.cleanup = func() {
 			os.Remove(eps[1])
@@ -79,7 +80,8 @@ func (s *nonBlockingGRPCServer) serve(ep string, ids csi.IdentityServer, cs csi.
 	}
 	listener, err := net.Listen(eps[0], eps[1])
 	if err != nil {
-		glog.Fatalf("Failed to listen: %v", err)
+		slog.Error("failed to listen", "err", err)
+		os.Exit(1)
 	}
 
 	opts := []grpc.ServerOption{
@@ -98,33 +100,36 @@ func (s *nonBlockingGRPCServer) serve(ep string, ids csi.IdentityServer, cs csi.
 		csi.RegisterNodeServer(server, ns)
 	}
 
-	glog.Infof("Listening for connections on address: %#v", listener.Addr())
+	slog.Info("listening for connections", "address", listener.Addr().String())
 
 	server.Serve(listener)
 
 }
 
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	pri := glog.Level(3)
-	if info.FullMethod == "/csi.v1.Identity/Probe" {
-		// This call occurs frequently, therefore it only gets log at level 5.
-		pri = 5
+	if r, ok := req.(interface{ GetSecrets() map[string]string }); ok {
+		for _, v := range r.GetSecrets() {
+			secrets.Add(v)
+		}
 	}
-	glog.V(pri).Infof("GRPC call: %s", info.FullMethod)
+	l := slog.Default().With(requestAttrs(info.FullMethod, req)...)
+	ctx = withLogger(ctx, l)
 
-	v5 := glog.V(5)
-	if v5 {
-		v5.Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+	lvl := slog.LevelInfo
+	if info.FullMethod == "/csi.v1.Identity/Probe" {
+		// This call occurs frequently, therefore it only gets log at debug level.
+		lvl = slog.LevelDebug
 	}
+	l.Log(ctx, lvl, "GRPC call")
+	l.Debug("GRPC request", "request", protosanitizer.StripSecrets(req).String())
+
 	resp, err := handler(ctx, req)
 	if err != nil {
-		// Always log errors. Probably not useful though without the method name?!
-		glog.Errorf("GRPC error: %v", err)
+		// Always log errors.
+		l.Error("GRPC error", "err", err)
 	}
 
-	if v5 {
-		v5.Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
-	}
+	l.Debug("GRPC response", "response", protosanitizer.StripSecrets(resp).String())
 
 	return resp, err
 }
@@ -0,0 +1,152 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// stagedMounter mounts each volume once per node, with rclone mount in its
+// staging directory, and bind mounts the staging directory to the targets
+// of the volume, which then share one VFS.
+type stagedMounter struct {
+	d *driver
+}
+
+var stagingLocks sync.Map
+
+// lockStaging serializes the mounts of the staging directory dir.
+func lockStaging(dir string) func() {
+	v, _ := stagingLocks.LoadOrStore(dir, &sync.Mutex{})
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// stagingDir is where the remote path of pub is mounted for all its bind
+// mounts.
+func (d *driver) stagingDir(pub *publication) string {
+	sum := sha256.Sum256([]byte(pub.Remote + ":" + pub.RemotePath))
+	return filepath.Join(d.config.StateDir, "staging", hex.EncodeToString(sum[:8]))
+}
+
+// staged returns the other publications bind mounted from the staging
+// directory of pub.
+func (d *driver) staged(pub *publication) []*publication {
+	others := []*publication{}
+	for _, o := range d.publications.list() {
+		if o.TargetPath != pub.TargetPath && o.Mounter == mounterBind && d.stagingDir(o) == d.stagingDir(pub) {
+			others = append(others, o)
+		}
+	}
+	return others
+}
+
+func (m stagedMounter) Mount(ctx context.Context, pub *publication, vfsOpt, mountOpt map[string]any) error {
+	if err := unmount(pub.TargetPath, m.d.config.HealthTimeout); err != nil {
+		return err
+	}
+	dir := m.d.stagingDir(pub)
+	defer lockStaging(dir)()
+	// the staging mount is shared with writable publications, read-only
+	// ones get a read-only bind mount
+	vfsOpt = maps.Clone(vfsOpt)
+	delete(vfsOpt, "ReadOnly")
+	opts, err := json.Marshal(map[string]any{"vfsOpt": vfsOpt, "mountOpt": mountOpt})
+	if err != nil {
+		return err
+	}
+	ok, err := mounted(dir, m.d.config.HealthTimeout)
+	if err != nil && !errors.Is(err, errStaleMount) {
+		return err
+	}
+	if !ok || err != nil {
+		staging := &publication{TargetPath: dir, Remote: pub.Remote, RemotePath: pub.RemotePath}
+		if err := (fuseMounter{m.d}).Mount(ctx, staging, vfsOpt, mountOpt); err != nil {
+			return fmt.Errorf("staging %s: %w", dir, err)
+		}
+		if err := os.WriteFile(dir+".json", opts, 0600); err != nil {
+			return errors.Join(err, m.unstage(ctx, pub))
+		}
+	} else if staged, err := os.ReadFile(dir + ".json"); err == nil && !bytes.Equal(staged, opts) {
+		// the VFS is shared, it can not have the options of both
+		return status.Errorf(codes.InvalidArgument, "the volume is mounted with other options by %s=%s publications on the node", mounterKey, mounterBind)
+	}
+	if err := bindMount(dir, pub.TargetPath, pub.Readonly); err != nil {
+		return errors.Join(err, m.unstage(ctx, pub))
+	}
+	return nil
+}
+
+func (m stagedMounter) Unmount(ctx context.Context, pub *publication) error {
+	if err := unmount(pub.TargetPath, m.d.config.HealthTimeout); err != nil {
+		return err
+	}
+	defer lockStaging(m.d.stagingDir(pub))()
+	return m.unstage(ctx, pub)
+}
+
+// unstage unmounts the staging directory of pub, unless other publications
+// are bind mounted from it.
+func (m stagedMounter) unstage(ctx context.Context, pub *publication) error {
+	if len(m.d.staged(pub)) > 0 {
+		return nil
+	}
+	dir := m.d.stagingDir(pub)
+	if err := (fuseMounter{m.d}).Unmount(ctx, &publication{TargetPath: dir}); err != nil {
+		return err
+	}
+	if err := os.Remove(dir + ".json"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (m stagedMounter) IsMounted(pub *publication) (bool, error) {
+	return mounted(pub.TargetPath, m.d.config.HealthTimeout)
+}
+
+func (m stagedMounter) Stats(ctx context.Context, pub *publication) ([]*csi.VolumeUsage, error) {
+	return statfsUsage(pub.TargetPath)
+}
+
+// Ready checks the prerequisites of the FUSE staging mounts.
+func (m stagedMounter) Ready() error {
+	return checkFuse()
+}
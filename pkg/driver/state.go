@@ -0,0 +1,133 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// readJSONFile decodes the json file at path into v, a missing file leaves v
+// untouched.
+func readJSONFile(path string, v any) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeJSONFile atomically replaces the file at path with v encoded as json.
+func writeJSONFile(path string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// remoteTmpDir holds the local copies of remote objects read or written by
+// the driver.
+func (d *driver) remoteTmpDir() string {
+	return filepath.Join(d.config.StateDir, "tmp")
+}
+
+// readRemoteJSON decodes the json object name of fs into v, and tells
+// whether it exists. Remote objects are read and written through local
+// files, because rc only moves files between remotes.
+func (d *driver) readRemoteJSON(ctx context.Context, fs, name string, v any) (bool, error) {
+	st, err := d.rc(ctx, "operations/stat", map[string]any{"fs": fs, "remote": name})
+	if err != nil {
+		return false, err
+	}
+	if !st.Get("item").IsObject() {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(d.remoteTmpDir(), 0700); err != nil {
+		return false, err
+	}
+	tmp, err := os.CreateTemp(d.remoteTmpDir(), "read.*")
+	if err != nil {
+		return false, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if _, err := d.rc(ctx, "operations/copyfile", map[string]any{
+		"srcFs":     fs,
+		"srcRemote": name,
+		"dstFs":     d.remoteTmpDir(),
+		"dstRemote": filepath.Base(tmp.Name()),
+	}); err != nil {
+		return false, err
+	}
+	if err := readJSONFile(tmp.Name(), v); err != nil {
+		return false, fmt.Errorf("corrupted %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// writeRemoteJSON replaces the object name of fs with v encoded as json.
+func (d *driver) writeRemoteJSON(ctx context.Context, fs, name string, v any) error {
+	if err := os.MkdirAll(d.remoteTmpDir(), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(d.remoteTmpDir(), "write.*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := writeJSONFile(tmp.Name(), v); err != nil {
+		return err
+	}
+	_, err = d.rc(ctx, "operations/copyfile", map[string]any{
+		"srcFs":     d.remoteTmpDir(),
+		"srcRemote": filepath.Base(tmp.Name()),
+		"dstFs":     fs,
+		"dstRemote": name,
+	})
+	return err
+}
@@ -0,0 +1,66 @@
+/*
+MIT License
+
+Copyright (c) 2023 xhe
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package driver
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// tasks are background goroutines of publications, by target path.
+type tasks struct {
+	mu     sync.Mutex
+	cancel map[string]context.CancelFunc
+}
+
+func newTasks() tasks {
+	return tasks{cancel: make(map[string]context.CancelFunc)}
+}
+
+// start runs f in the background until stop is called for target, a
+// previous task of target is stopped.
+func (t *tasks) start(target string, f func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.mu.Lock()
+	if c, ok := t.cancel[target]; ok {
+		c()
+	}
+	t.cancel[target] = cancel
+	t.mu.Unlock()
+	go f(ctx)
+}
+
+// stop cancels the task of target, and reports whether one was running.
+func (t *tasks) stop(target string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.cancel[target]
+	if ok {
+		c()
+		delete(t.cancel, target)
+	}
+	return ok
+}